@@ -0,0 +1,125 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+type Association struct {
+	ID    string `json:"id"`
+	IDKey []byte `json:"idKey"`
+	Hash  string `json:"hash,omitempty"` // hash of the associated database
+}
+
+// Identity is a set of associations with different databases.
+//
+// An identity with a single association is stored as a plain JSON object,
+// so files written by older versions remain valid.
+type Identity []Association
+
+func (id Identity) MarshalJSON() ([]byte, error) {
+	if len(id) == 1 {
+		return json.Marshal(id[0])
+	}
+
+	return json.Marshal([]Association(id))
+}
+
+func (id *Identity) UnmarshalJSON(b []byte) error {
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '{' {
+		var as Association
+		if err := json.Unmarshal(b, &as); err != nil {
+			return err
+		}
+		*id = Identity{as}
+		return nil
+	}
+
+	return json.Unmarshal(b, (*[]Association)(id))
+}
+
+// Find returns the association for the database with the given hash.
+// Associations saved without a hash are used as a fallback.
+func (id Identity) Find(hash string) (as *Association, ok bool) {
+	for i := range id {
+		if id[i].Hash == hash {
+			return &id[i], true
+		}
+	}
+
+	for i := range id {
+		if id[i].Hash == "" {
+			return &id[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// Set adds the association, replacing any association with the same hash.
+func (id *Identity) Set(as Association) {
+	for i := range *id {
+		if (*id)[i].Hash == as.Hash {
+			(*id)[i] = as
+			return
+		}
+	}
+
+	*id = append(*id, as)
+}
+
+func loadIdentity(r io.Reader) (id Identity, err error) {
+	if err = json.NewDecoder(r).Decode(&id); err != nil {
+		return nil, fmt.Errorf("failed to decode saved association info: %w", err)
+	}
+
+	return id, nil
+}
+
+func saveIdentity(file string, id Identity) (err error) {
+	var w io.WriteCloser
+	if file == "" || file == "-" {
+		w = os.Stdout
+	} else {
+		if err = os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+			// we may try to ignore the error and hope that WriteFile succeeds anyway
+			log.Println("info:", err)
+		}
+
+		w, err = os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+
+	return json.NewEncoder(w).Encode(id)
+}
@@ -24,7 +24,12 @@
 package kpclient
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
+	"time"
 )
 
 var (
@@ -44,6 +49,25 @@ var (
 	ErrEmptyMessageReceived       = errors.New("empty message received")
 	ErrNoURLProvided              = errors.New("no url provided")
 	ErrNoLoginsFound              = errors.New("no logins found")
+	ErrNoGroupsFound              = errors.New("no groups found")
+	ErrCannotCreateNewGroup       = errors.New("cannot create new group")
+	ErrNoValidUUIDProvided        = errors.New("no valid uuid provided")
+	ErrAccessToAllEntriesDenied   = errors.New("access to all entries is denied")
+
+	ErrPasskeysAttestationNotSupported = errors.New("attestation not supported")
+	ErrPasskeysCredentialIsExcluded    = errors.New("credential is excluded")
+	ErrPasskeysRequestCanceled         = errors.New("passkeys request canceled")
+	ErrPasskeysInvalidUserVerification = errors.New("invalid user verification")
+	ErrPasskeysEmptyPublicKey          = errors.New("empty public key")
+	ErrPasskeysInvalidURLProvided      = errors.New("invalid URL provided")
+	ErrPasskeysOriginNotAllowed        = errors.New("origin is not allowed")
+	ErrPasskeysDomainIsNotValid        = errors.New("domain is not valid")
+	ErrPasskeysDomainRPIDMismatch      = errors.New("domain does not match relying party ID")
+	ErrPasskeysNoSupportedAlgorithms   = errors.New("no supported algorithms were provided")
+	ErrPasskeysWaitForLifetimer        = errors.New("wait for timer to expire")
+	ErrPasskeysUnknownError            = errors.New("unknown passkeys error")
+	ErrPasskeysInvalidChallenge        = errors.New("challenge is shorter than required minimum length")
+	ErrPasskeysInvalidUserID           = errors.New("user.id does not match the required length")
 )
 
 const (
@@ -63,9 +87,63 @@ const (
 	CodeEmptyMessageReceived       = 13
 	CodeNoURLProvided              = 14
 	CodeNoLoginsFound              = 15
+	CodeNoGroupsFound              = 16
+	CodeCannotCreateNewGroup       = 17
+	CodeNoValidUUIDProvided        = 18
+	CodeAccessToAllEntriesDenied   = 19
+
+	CodePasskeysAttestationNotSupported = 20
+	CodePasskeysCredentialIsExcluded    = 21
+	CodePasskeysRequestCanceled         = 22
+	CodePasskeysInvalidUserVerification = 23
+	CodePasskeysEmptyPublicKey          = 24
+	CodePasskeysInvalidURLProvided      = 25
+	CodePasskeysOriginNotAllowed        = 26
+	CodePasskeysDomainIsNotValid        = 27
+	CodePasskeysDomainRPIDMismatch      = 28
+	CodePasskeysNoSupportedAlgorithms   = 29
+	CodePasskeysWaitForLifetimer        = 30
+	CodePasskeysUnknownError            = 31
+	CodePasskeysInvalidChallenge        = 32
+	CodePasskeysInvalidUserID           = 33
 )
 
-func protocolError(msg string, code int) error {
+// ProtocolError is an error reply from KeePassXC. It matches the sentinel
+// error for its code, e.g. ErrNoLoginsFound, with errors.Is.
+type ProtocolError struct {
+	Code    int
+	Message string // as sent by KeePassXC, may be empty
+	Action  string // action of the failed request
+}
+
+func (e *ProtocolError) Error() string {
+	switch {
+	case e.Message != "":
+		return e.Message
+	case codeError(e.Code) != nil:
+		return codeError(e.Code).Error()
+	default:
+		return "error code " + strconv.Itoa(e.Code)
+	}
+}
+
+// Unwrap returns the sentinel error for the code, if there is one.
+func (e *ProtocolError) Unwrap() error {
+	return codeError(e.Code)
+}
+
+func protocolError(action, msg string, code *int) error {
+	e := &ProtocolError{Code: CodeUnknownError, Message: msg, Action: action}
+	if code != nil {
+		e.Code = *code
+	}
+
+	return e
+}
+
+// codeError returns the sentinel error for an error code, or nil if the
+// code is unknown.
+func codeError(code int) error {
 	switch code {
 	case CodeUnknownError:
 		return ErrUnknownError
@@ -99,94 +177,542 @@ func protocolError(msg string, code int) error {
 		return ErrNoURLProvided
 	case CodeNoLoginsFound:
 		return ErrNoLoginsFound
+	case CodeNoGroupsFound:
+		return ErrNoGroupsFound
+	case CodeCannotCreateNewGroup:
+		return ErrCannotCreateNewGroup
+	case CodeNoValidUUIDProvided:
+		return ErrNoValidUUIDProvided
+	case CodeAccessToAllEntriesDenied:
+		return ErrAccessToAllEntriesDenied
+	case CodePasskeysAttestationNotSupported:
+		return ErrPasskeysAttestationNotSupported
+	case CodePasskeysCredentialIsExcluded:
+		return ErrPasskeysCredentialIsExcluded
+	case CodePasskeysRequestCanceled:
+		return ErrPasskeysRequestCanceled
+	case CodePasskeysInvalidUserVerification:
+		return ErrPasskeysInvalidUserVerification
+	case CodePasskeysEmptyPublicKey:
+		return ErrPasskeysEmptyPublicKey
+	case CodePasskeysInvalidURLProvided:
+		return ErrPasskeysInvalidURLProvided
+	case CodePasskeysOriginNotAllowed:
+		return ErrPasskeysOriginNotAllowed
+	case CodePasskeysDomainIsNotValid:
+		return ErrPasskeysDomainIsNotValid
+	case CodePasskeysDomainRPIDMismatch:
+		return ErrPasskeysDomainRPIDMismatch
+	case CodePasskeysNoSupportedAlgorithms:
+		return ErrPasskeysNoSupportedAlgorithms
+	case CodePasskeysWaitForLifetimer:
+		return ErrPasskeysWaitForLifetimer
+	case CodePasskeysUnknownError:
+		return ErrPasskeysUnknownError
+	case CodePasskeysInvalidChallenge:
+		return ErrPasskeysInvalidChallenge
+	case CodePasskeysInvalidUserID:
+		return ErrPasskeysInvalidUserID
 	default:
-		return errors.New(msg) // nolint
+		return nil
 	}
 }
 
 func (c *Client) ChangePublicKeys() (resp ChangePublicKeysResponse, err error) {
+	return c.ChangePublicKeysContext(context.Background())
+}
+
+// ChangePublicKeysContext is like ChangePublicKeys but the request is bounded by ctx.
+func (c *Client) ChangePublicKeysContext(ctx context.Context) (resp ChangePublicKeysResponse, err error) {
+	nonce := c.nonce()
 	req := ChangePublicKeysRequest{
 		Request: Request{
 			Action:   ActionChangePublicKeys,
-			Nonce:    c.nonce()[:],
+			Nonce:    nonce[:],
 			ClientID: c.clientID[:],
 		},
 		PulicKey: c.pubkey[:],
 	}
 
-	if err = c.send(req, &resp); err != nil {
+	e := Exchange{Action: req.Action, Start: time.Now()}
+	defer func() {
+		e.Duration = time.Since(e.Start)
+		e.Err = err
+		c.observe(e)
+	}()
+
+	// The request isn't encrypted, so it is sent as is.
+	e.Sent, e.Received, err = c.send(ctx, req.Action, nonce, req, &resp)
+	e.Request, e.Reply = e.Sent, e.Received
+	if err != nil {
 		return
 	}
+	reply := e.Received
 
 	if resp.Error != nil {
-		c := 0
-		if resp.Code != nil {
-			c = *resp.Code
-		}
+		e.Reply, e.Error = nil, reply
+		err = protocolError(req.Action, *resp.Error, resp.Code)
 
-		err = protocolError(*resp.Error, c)
+		return
+	}
 
+	if _, err = checkNonce(nonce, resp.Nonce); err != nil {
 		return
 	}
 
-	copy(c.lastNonce[:], resp.Nonce)
+	c.mu.Lock()
 	copy(c.serverPubkey[:], resp.PulicKey)
+	c.mu.Unlock()
+
+	if resp.Version != nil {
+		c.setVersion(*resp.Version)
+	}
 
 	return resp, err
 }
 
 func (c *Client) Associate() (resp AssociateResponse, err error) {
+	return c.AssociateContext(context.Background())
+}
+
+// AssociateContext is like Associate but the request is bounded by ctx.
+func (c *Client) AssociateContext(ctx context.Context) (resp AssociateResponse, err error) {
+	idKey, _ := c.AssociationData()
 	m := AssociateRequest{
 		Action: ActionAssociate,
 		Key:    c.pubkey[:],
-		IDKey:  c.idKey[:],
+		IDKey:  idKey[:],
 	}
 
-	if err = c.sendMessageWithRetry(m.Action, m, &resp, true); err != nil {
+	if err = c.sendMessageWithRetry(ctx, m.Action, m, &resp, true); err != nil {
 		return
 	}
 
-	c.identifier = resp.ID
+	c.SetAssociation(idKey[:], resp.ID)
 
 	return
 }
 
 func (c *Client) TestAssociate(triggerUnlock bool) (resp TestAssociateResponse, err error) {
+	return c.TestAssociateContext(context.Background(), triggerUnlock)
+}
+
+// TestAssociateContext is like TestAssociate but the request is bounded by ctx.
+func (c *Client) TestAssociateContext(
+	ctx context.Context, triggerUnlock bool,
+) (resp TestAssociateResponse, err error) {
+	idKey, identifier := c.AssociationData()
 	m := TestAssociateRequest{
 		Action: ActionTestAssociate,
 		DBKey: DBKey{
-			ID:  c.identifier,
-			Key: c.idKey[:],
+			ID:  identifier,
+			Key: idKey[:],
 		},
 	}
 
-	err = c.sendMessageWithRetry(m.Action, m, &resp, triggerUnlock)
+	err = c.sendMessageWithRetry(ctx, m.Action, m, &resp, triggerUnlock)
 
 	return
 }
 
-func (c *Client) GetLogins(url string) (resp GetLoginsResponse, err error) {
+// GetLoginsOptions narrow down the entries returned by GetLogins the same way
+// the browser extension does.
+type GetLoginsOptions struct {
+	// SubmitURL is the URL a login form is submitted to. It's matched
+	// against the entries' submit URLs.
+	SubmitURL string
+	// HTTPAuth requests entries intended for HTTP basic authentication.
+	HTTPAuth bool
+}
+
+// GetLogins returns the entries matching url from all associated databases.
+// Each entry's Database is set to the ID of the association it was found with.
+//
+// KeePassXC accepts several keys in one get-logins request, but its reply
+// doesn't say which database an entry belongs to. So when the client has
+// several associations, each database is queried separately. A database
+// that fails, e.g. because it is locked, is skipped; its error is only
+// returned if no database returned any entries.
+func (c *Client) GetLogins(url string, opts GetLoginsOptions) (resp GetLoginsResponse, err error) {
+	return c.GetLoginsContext(context.Background(), url, opts)
+}
+
+// GetLoginsContext is like GetLogins but the request is bounded by ctx.
+func (c *Client) GetLoginsContext(
+	ctx context.Context, url string, opts GetLoginsOptions,
+) (resp GetLoginsResponse, err error) {
+	keys := c.Associations()
+	if len(keys) <= 1 {
+		return c.getLogins(ctx, url, opts, keys)
+	}
+
+	var failed error // first error other than "no logins found"
+	replied := false
+	for _, k := range keys {
+		r, err := c.getLogins(ctx, url, opts, []DBKey{k})
+		if ctx.Err() != nil {
+			return resp, ctx.Err()
+		}
+		if err != nil {
+			if !errors.Is(err, ErrNoLoginsFound) && failed == nil {
+				failed = fmt.Errorf("database %s: %w", k.ID, err)
+			}
+			c.logf("debug: get-logins skipped database %s: %v", k.ID, err)
+			continue
+		}
+
+		// The reply fields, such as the hash, are those of the first
+		// database that returned entries.
+		if !replied {
+			resp.Response = r.Response
+			replied = true
+		}
+		resp.Entries = append(resp.Entries, r.Entries...)
+	}
+
+	if len(resp.Entries) == 0 {
+		if failed != nil {
+			return resp, failed
+		}
+		return resp, ErrNoLoginsFound
+	}
+	resp.Count = len(resp.Entries)
+
+	return resp, nil
+}
+
+func (c *Client) getLogins(
+	ctx context.Context, url string, opts GetLoginsOptions, keys []DBKey,
+) (resp GetLoginsResponse, err error) {
 	m := GetLoginsRequest{
-		Action: ActionGetLogins,
-		URL:    url,
-		Keys: []DBKey{{
-			ID:  c.identifier,
-			Key: c.idKey[:],
-		}},
+		Action:    ActionGetLogins,
+		URL:       url,
+		SubmitURL: opts.SubmitURL,
+		Keys:      keys,
+	}
+
+	if opts.HTTPAuth {
+		m.HTTPAuth = "true"
 	}
 
-	err = c.sendMessageWithRetry(m.Action, m, &resp, true)
+	if err = c.sendMessageWithRetry(ctx, m.Action, m, &resp, true); err != nil {
+		return
+	}
+
+	if len(keys) == 1 {
+		for i := range resp.Entries {
+			resp.Entries[i].Database = keys[0].ID
+		}
+	}
 
 	return
 }
 
 func (c *Client) GetTOTP(uuid string) (resp GetTOTPResponse, err error) {
+	return c.GetTOTPContext(context.Background(), uuid)
+}
+
+// GetTOTPContext is like GetTOTP but the request is bounded by ctx.
+func (c *Client) GetTOTPContext(ctx context.Context, uuid string) (resp GetTOTPResponse, err error) {
 	m := GetTOTPRequest{
 		Action: ActionGetTOTP,
 		UUID:   uuid,
 	}
 
-	err = c.sendMessageWithRetry(m.Action, m, &resp, true)
+	err = c.sendMessageWithRetry(ctx, m.Action, m, &resp, true)
+
+	return
+}
+
+func (c *Client) GeneratePassword() (resp GeneratePasswordResponse, err error) {
+	return c.GeneratePasswordContext(context.Background())
+}
+
+// GeneratePasswordContext is like GeneratePassword but the request is bounded by ctx.
+func (c *Client) GeneratePasswordContext(ctx context.Context) (resp GeneratePasswordResponse, err error) {
+	m := GeneratePasswordRequest{
+		Action: ActionGeneratePassword,
+	}
+
+	if err = c.sendMessageWithRetry(ctx, m.Action, m, &resp, true); err != nil {
+		return
+	}
+
+	if resp.Password == "" && len(resp.Entries) > 0 {
+		resp.Password = resp.Entries[0].Password
+	}
+
+	return
+}
+
+// LoginOptions describes an entry to be created or updated with SetLogin.
+// If UUID is empty, a new entry is created. If Group and GroupUUID are
+// empty, KeePassXC stores the entry in its default group.
+type LoginOptions struct {
+	URL       string
+	SubmitURL string
+	Login     string
+	Password  string
+	Group     string
+	GroupUUID string
+	UUID      string
+}
+
+func (c *Client) SetLogin(opts LoginOptions) (resp SetLoginResponse, err error) {
+	return c.SetLoginContext(context.Background(), opts)
+}
+
+// SetLoginContext is like SetLogin but the request is bounded by ctx.
+func (c *Client) SetLoginContext(ctx context.Context, opts LoginOptions) (resp SetLoginResponse, err error) {
+	_, identifier := c.AssociationData()
+	m := SetLoginRequest{
+		Action:    ActionSetLogin,
+		ID:        identifier,
+		URL:       opts.URL,
+		SubmitURL: opts.SubmitURL,
+		Login:     opts.Login,
+		Password:  opts.Password,
+		Group:     opts.Group,
+		GroupUUID: opts.GroupUUID,
+		UUID:      opts.UUID,
+	}
+
+	if m.SubmitURL == "" {
+		m.SubmitURL = m.URL
+	}
+
+	err = c.sendMessageWithRetry(ctx, m.Action, m, &resp, true)
+
+	return
+}
+
+// GetDatabaseHash returns the hash identifying the currently active database.
+func (c *Client) GetDatabaseHash(triggerUnlock bool) (hash string, err error) {
+	return c.GetDatabaseHashContext(context.Background(), triggerUnlock)
+}
+
+// GetDatabaseHashContext is like GetDatabaseHash but the request is bounded by ctx.
+func (c *Client) GetDatabaseHashContext(ctx context.Context, triggerUnlock bool) (hash string, err error) {
+	m := GetDatabaseHashRequest{
+		Action: ActionGetDatabaseHash,
+	}
+
+	var resp GetDatabaseHashResponse
+	if err = c.sendMessageWithRetry(ctx, m.Action, m, &resp, triggerUnlock); err != nil {
+		return
+	}
+
+	if resp.Hash == nil || *resp.Hash == "" {
+		return "", ErrDatabaseHashNotReceived
+	}
+
+	return *resp.Hash, nil
+}
+
+// LockDatabase locks the currently active database. It succeeds if no
+// database is unlocked.
+func (c *Client) LockDatabase() (resp LockDatabaseResponse, err error) {
+	return c.LockDatabaseContext(context.Background())
+}
+
+// LockDatabaseContext is like LockDatabase but the request is bounded by ctx.
+func (c *Client) LockDatabaseContext(ctx context.Context) (resp LockDatabaseResponse, err error) {
+	m := LockDatabaseRequest{
+		Action: ActionLockDatabase,
+	}
+
+	err = c.sendMessageWithRetry(ctx, m.Action, m, &resp, false)
+
+	// There is nothing to lock. KeePassXC rejects requests with "database
+	// not opened" when no database is unlocked and triggerUnlock isn't set
+	// (processClientMessage in src/browser/BrowserAction.cpp), and
+	// handleLockDatabase replies "database hash not received" if the
+	// database is open but its hash is empty.
+	if errors.Is(err, ErrDatabaseNotOpened) || errors.Is(err, ErrDatabaseHashNotReceived) {
+		err = nil
+	}
+
+	return
+}
+
+// GetDatabaseGroups returns the group tree of the active database. The tree
+// has a single root group.
+func (c *Client) GetDatabaseGroups() (resp GetDatabaseGroupsResponse, err error) {
+	return c.GetDatabaseGroupsContext(context.Background())
+}
+
+// GetDatabaseGroupsContext is like GetDatabaseGroups but the request is bounded by ctx.
+func (c *Client) GetDatabaseGroupsContext(ctx context.Context) (resp GetDatabaseGroupsResponse, err error) {
+	m := GetDatabaseGroupsRequest{
+		Action: ActionGetDatabaseGroups,
+	}
+
+	err = c.sendMessageWithRetry(ctx, m.Action, m, &resp, true)
+
+	return
+}
+
+// CreateNewGroup creates a group with the given slash-separated path relative
+// to the root group. Missing parent groups are created as well. If the group
+// already exists, it is returned as is.
+func (c *Client) CreateNewGroup(path string) (resp CreateNewGroupResponse, err error) {
+	return c.CreateNewGroupContext(context.Background(), path)
+}
+
+// CreateNewGroupContext is like CreateNewGroup but the request is bounded by ctx.
+func (c *Client) CreateNewGroupContext(
+	ctx context.Context, path string,
+) (resp CreateNewGroupResponse, err error) {
+	m := CreateNewGroupRequest{
+		Action:    ActionCreateNewGroup,
+		GroupName: path,
+	}
+
+	err = c.sendMessageWithRetry(ctx, m.Action, m, &resp, true)
+
+	return
+}
+
+// ErrEntryNotDeleted is returned by DeleteEntry when KeePassXC didn't delete
+// the entry. KeePassXC doesn't say why: there may be no entry with the UUID,
+// or the user refused.
+var ErrEntryNotDeleted = errors.New("entry not deleted")
+
+// DeleteEntry deletes the entry with the given UUID. KeePassXC asks the user
+// for confirmation. ErrEntryNotDeleted is returned if they refuse or if there
+// is no such entry.
+func (c *Client) DeleteEntry(uuid string) (resp DeleteEntryResponse, err error) {
+	return c.DeleteEntryContext(context.Background(), uuid)
+}
+
+// DeleteEntryContext is like DeleteEntry but the request is bounded by ctx.
+func (c *Client) DeleteEntryContext(ctx context.Context, uuid string) (resp DeleteEntryResponse, err error) {
+	m := DeleteEntryRequest{
+		Action: ActionDeleteEntry,
+		UUID:   uuid,
+	}
+
+	if err = c.sendMessageWithRetry(ctx, m.Action, m, &resp, true); err != nil {
+		return
+	}
+
+	if resp.Success != nil && !*resp.Success {
+		err = ErrEntryNotDeleted
+	}
+
+	return
+}
+
+// RequestAutotype asks KeePassXC to perform Global Auto-Type into the
+// currently focused window using the entries matching search, which is
+// usually a URL or a domain.
+func (c *Client) RequestAutotype(search string) (resp RequestAutotypeResponse, err error) {
+	return c.RequestAutotypeContext(context.Background(), search)
+}
+
+// RequestAutotypeContext is like RequestAutotype but the request is bounded by ctx.
+func (c *Client) RequestAutotypeContext(
+	ctx context.Context, search string,
+) (resp RequestAutotypeResponse, err error) {
+	m := RequestAutotypeRequest{
+		Action: ActionRequestAutotype,
+		Search: search,
+	}
+
+	err = c.sendMessageWithRetry(ctx, m.Action, m, &resp, true)
+
+	return
+}
+
+// passkeysResponse is the reply to passkeys actions. KeePassXC reports
+// passkey errors inside the encrypted "response" object instead of using the
+// top-level error fields.
+type passkeysResponse struct {
+	Response
+	Result json.RawMessage `json:"response"`
+}
+
+func (r *passkeysResponse) credential(action string, v interface{}) error {
+	if len(r.Result) == 0 {
+		return ErrEmptyMessageReceived
+	}
+
+	var e struct {
+		Code json.RawMessage `json:"errorCode"`
+	}
+	if err := json.Unmarshal(r.Result, &e); err != nil {
+		return err
+	}
+
+	if e.Code != nil {
+		s, err := strconv.Unquote(string(e.Code))
+		if err != nil {
+			s = string(e.Code)
+		}
+		code, err := strconv.Atoi(s)
+		if err != nil {
+			code = CodePasskeysUnknownError
+		}
+		return protocolError(action, "", &code)
+	}
+
+	return json.Unmarshal(r.Result, v)
+}
+
+// PasskeysGet asks KeePassXC for an assertion of a passkey stored for origin.
+func (c *Client) PasskeysGet(
+	options PublicKeyCredentialRequestOptions, origin string,
+) (resp PasskeysGetResponse, err error) {
+	return c.PasskeysGetContext(context.Background(), options, origin)
+}
+
+// PasskeysGetContext is like PasskeysGet but the request is bounded by ctx.
+func (c *Client) PasskeysGetContext(
+	ctx context.Context, options PublicKeyCredentialRequestOptions, origin string,
+) (resp PasskeysGetResponse, err error) {
+	m := PasskeysGetRequest{
+		Action:    ActionPasskeysGet,
+		PublicKey: options,
+		Origin:    origin,
+		Keys:      c.Associations(),
+	}
+
+	var r passkeysResponse
+	if err = c.sendMessageWithRetry(ctx, m.Action, m, &r, true); err != nil {
+		return
+	}
+
+	resp.Response = r.Response
+	err = r.credential(m.Action, &resp.Credential)
+
+	return
+}
+
+// PasskeysRegister asks KeePassXC to create a new passkey for origin.
+func (c *Client) PasskeysRegister(
+	options PublicKeyCredentialCreationOptions, origin string,
+) (resp PasskeysRegisterResponse, err error) {
+	return c.PasskeysRegisterContext(context.Background(), options, origin)
+}
+
+// PasskeysRegisterContext is like PasskeysRegister but the request is bounded by ctx.
+func (c *Client) PasskeysRegisterContext(
+	ctx context.Context, options PublicKeyCredentialCreationOptions, origin string,
+) (resp PasskeysRegisterResponse, err error) {
+	m := PasskeysRegisterRequest{
+		Action:    ActionPasskeysRegister,
+		PublicKey: options,
+		Origin:    origin,
+		Keys:      c.Associations(),
+	}
+
+	var r passkeysResponse
+	if err = c.sendMessageWithRetry(ctx, m.Action, m, &r, true); err != nil {
+		return
+	}
+
+	resp.Response = r.Response
+	err = r.credential(m.Action, &resp.Credential)
 
 	return
 }
@@ -26,11 +26,13 @@ package kpclient
 import (
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"net"
 	"testing"
 
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/net/nettest"
+	"gotest.tools/assert"
 )
 
 type mockKeePass struct {
@@ -80,6 +82,10 @@ func (m *mockKeePass) Conn() net.Conn {
 	return c
 }
 
+func (m *mockKeePass) Transport() Transport {
+	return NewSocketTransport(m.Conn())
+}
+
 func Test_newMockKeePass(t *testing.T) {
 	m := newMockKeePass(func(c net.Conn) {})
 	m.Conn()
@@ -88,17 +94,31 @@ func Test_newMockKeePass(t *testing.T) {
 
 func TestClient_ChangePublicKeys(t *testing.T) {
 	tests := []struct {
-		name     string
-		resp     interface{}
-		wantResp ChangePublicKeysResponse
-		wantErr  bool
+		name    string
+		resp    interface{}
+		nonce   func(n *[24]byte) []byte // nonce of the reply to a request with nonce n
+		wantErr error
 	}{
 		{
-			resp: ChangePublicKeysResponse{},
+			name: "ok",
+			resp: ChangePublicKeysResponse{PulicKey: []byte("server key")},
 		},
 		{
+			name:    "not a response",
 			resp:    "a",
-			wantErr: true,
+			wantErr: errors.New("any"),
+		},
+		{
+			name:    "request nonce",
+			resp:    ChangePublicKeysResponse{PulicKey: []byte("server key")},
+			nonce:   func(n *[24]byte) []byte { return n[:] },
+			wantErr: ErrNonceMismatch,
+		},
+		{
+			name:    "no nonce",
+			resp:    ChangePublicKeysResponse{PulicKey: []byte("server key")},
+			nonce:   func(n *[24]byte) []byte { return nil },
+			wantErr: ErrNonceMismatch,
 		},
 	}
 	for _, tt := range tests {
@@ -110,11 +130,20 @@ func TestClient_ChangePublicKeys(t *testing.T) {
 					t.Error(err)
 				}
 				if req.Action != ActionChangePublicKeys ||
-					len(req.Nonce) == 0 ||
+					len(req.Nonce) != 24 ||
 					len(req.PulicKey) == 0 {
 					t.Errorf("bad request: %+v", req)
 				}
-				err = json.NewEncoder(c).Encode(tt.resp)
+
+				resp := tt.resp
+				if r, ok := resp.(ChangePublicKeysResponse); ok {
+					r.Nonce = incrementNonce((*[24]byte)(req.Nonce))[:]
+					if tt.nonce != nil {
+						r.Nonce = tt.nonce((*[24]byte)(req.Nonce))
+					}
+					resp = r
+				}
+				err = json.NewEncoder(c).Encode(resp)
 				if err != nil {
 					t.Error(err)
 				}
@@ -122,13 +151,23 @@ func TestClient_ChangePublicKeys(t *testing.T) {
 			})
 			defer k.Close()
 
-			c, err := New(k.Conn(), nil, nil, "")
+			c, err := New(k.Transport(), nil, nil, "")
 			if err != nil {
 				t.Fatal(err)
 			}
 			resp, err := c.ChangePublicKeys()
-			if (err != nil) != tt.wantErr {
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("resp=%v err=%v", resp, err)
+			case tt.wantErr == ErrNonceMismatch && !errors.Is(err, ErrNonceMismatch):
 				t.Fatalf("resp=%v wantErr=%v err=%v", resp, tt.wantErr, err)
+			case tt.wantErr != nil && err == nil:
+				t.Fatalf("resp=%v wantErr=%v", resp, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				assert.Equal(t, c.serverKey(), [32]byte{'s', 'e', 'r', 'v', 'e', 'r', ' ', 'k', 'e', 'y'})
+			} else {
+				assert.Equal(t, c.serverKey(), [32]byte{})
 			}
 		})
 	}
@@ -174,7 +213,7 @@ func TestClient_Associate(t *testing.T) {
 			})
 			defer k.Close()
 
-			c, err := New(k.Conn(), nil, nil, "")
+			c, err := New(k.Transport(), nil, nil, "")
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -189,3 +228,610 @@ func TestClient_Associate(t *testing.T) {
 		})
 	}
 }
+
+// newMockClient returns a client connected to a mock that answers a single
+// request of the given action with an encrypted reply. The decrypted request
+// message is sent to the returned channel.
+func newMockClient(t *testing.T, action string, reply string) (*Client, <-chan []byte) {
+	t.Helper()
+
+	msgs := make(chan []byte, 1)
+	c := newMockClientFunc(t, func(req Request, msg []byte) interface{} {
+		if req.Action != action {
+			t.Errorf("bad request: %+v", req)
+		}
+		msgs <- msg
+		return reply
+	})
+
+	return c, msgs
+}
+
+// mockReply is an encrypted reply with the given nonce instead of the
+// incremented request nonce.
+type mockReply struct {
+	Nonce   []byte
+	Message string
+}
+
+// newMockClientFunc returns a client connected to a mock that answers each
+// request with the result of handle, which gets the decrypted message.
+// A mockReply result is sent encrypted with its own nonce.
+// handle is called concurrently for requests sent concurrently.
+// A string result is sent as an encrypted message, a Response as is.
+func newMockClientFunc(t testing.TB, handle func(req Request, msg []byte) interface{}) *Client {
+	t.Helper()
+
+	spubkey, sprivkey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pubkey [32]byte
+	ct, st := Pipe()
+	t.Cleanup(func() { st.Close() })
+	go func() {
+		for {
+			b, err := st.Receive()
+			if err != nil {
+				return
+			}
+			var req Request
+			if err := json.Unmarshal(b, &req); err != nil || len(req.Nonce) != 24 {
+				t.Errorf("bad request: %s", b)
+				return
+			}
+			msg, ok := box.Open([]byte{}, req.Message, (*[24]byte)(req.Nonce), &pubkey, sprivkey)
+			if !ok {
+				t.Error("failed to open request message")
+			}
+
+			// Requests are handled concurrently, like KeePassXC does while
+			// a dialog is open.
+			go func() {
+				var resp interface{}
+				switch r := handle(req, msg).(type) {
+				case string:
+					nonce := incrementNonce((*[24]byte)(req.Nonce))[:]
+					resp = Response{
+						Nonce:   nonce,
+						Message: box.Seal([]byte{}, []byte(r), (*[24]byte)(nonce), &pubkey, sprivkey),
+					}
+				case mockReply:
+					resp = Response{
+						Nonce:   r.Nonce,
+						Message: box.Seal([]byte{}, []byte(r.Message), (*[24]byte)(r.Nonce), &pubkey, sprivkey),
+					}
+				default:
+					resp = r
+				}
+				b, err := json.Marshal(resp)
+				if err != nil {
+					t.Error(err)
+				}
+				_ = st.Send(b)
+			}()
+		}
+	}()
+
+	c, err := New(ct, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.serverPubkey = *spubkey
+	pubkey = c.pubkey
+
+	return c
+}
+
+func TestClient_GeneratePassword(t *testing.T) {
+	tests := []struct {
+		name         string
+		reply        string
+		wantPassword string
+	}{
+		{"current", `{"password":"hunter2","success":"true"}`, "hunter2"},
+		{"pre 2.7", `{"entries":[{"login":"96","password":"hunter2"}],"success":"true"}`, "hunter2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newMockClient(t, ActionGeneratePassword, tt.reply)
+
+			resp, err := c.GeneratePassword()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Password != tt.wantPassword {
+				t.Errorf("got password %q, want %q", resp.Password, tt.wantPassword)
+			}
+		})
+	}
+}
+
+func TestClient_SetLogin(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    LoginOptions
+		want    SetLoginRequest
+		reply   string
+		wantErr bool
+	}{
+		{
+			name:  "new entry",
+			opts:  LoginOptions{URL: "https://example.com", Login: "user", Password: "pass", Group: "Work"},
+			want:  SetLoginRequest{URL: "https://example.com", SubmitURL: "https://example.com", Login: "user", Password: "pass", Group: "Work"},
+			reply: `{"success":"true"}`,
+		},
+		{
+			name:  "update",
+			opts:  LoginOptions{URL: "https://example.com", SubmitURL: "https://example.com/login", UUID: "d1e6cba53ad04e8fb23f2991c160ce5a"},
+			want:  SetLoginRequest{URL: "https://example.com", SubmitURL: "https://example.com/login", UUID: "d1e6cba53ad04e8fb23f2991c160ce5a"},
+			reply: `{"success":"true"}`,
+		},
+		{
+			name:    "bad reply",
+			reply:   `"a"`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, msgs := newMockClient(t, ActionSetLogin, tt.reply)
+			c.identifier = "kpxcpc"
+
+			_, err := c.SetLogin(tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wantErr=%v err=%v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var got SetLoginRequest
+			if err := json.Unmarshal(<-msgs, &got); err != nil {
+				t.Fatal(err)
+			}
+			tt.want.Action = ActionSetLogin
+			tt.want.ID = "kpxcpc"
+			assert.DeepEqual(t, got, tt.want)
+		})
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	code := func(c int) *int { return &c }
+
+	tests := []struct {
+		name     string
+		msg      string
+		code     *int
+		want     ProtocolError
+		wantIs   error
+		wantText string
+	}{
+		{
+			name:     "known code",
+			msg:      "No logins found",
+			code:     code(CodeNoLoginsFound),
+			want:     ProtocolError{Code: CodeNoLoginsFound, Message: "No logins found", Action: ActionGeneratePassword},
+			wantIs:   ErrNoLoginsFound,
+			wantText: "No logins found",
+		},
+		{
+			name:     "no code",
+			msg:      "Something went wrong",
+			want:     ProtocolError{Code: CodeUnknownError, Message: "Something went wrong", Action: ActionGeneratePassword},
+			wantIs:   ErrUnknownError,
+			wantText: "Something went wrong",
+		},
+		{
+			name:     "unknown code",
+			code:     code(1000),
+			want:     ProtocolError{Code: 1000, Action: ActionGeneratePassword},
+			wantText: "error code 1000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newMockClientFunc(t, func(req Request, msg []byte) interface{} {
+				return Response{Error: &tt.msg, Code: tt.code}
+			})
+
+			_, err := c.GeneratePassword()
+
+			var pe *ProtocolError
+			assert.Assert(t, errors.As(err, &pe), err)
+			assert.DeepEqual(t, *pe, tt.want)
+			assert.Equal(t, err.Error(), tt.wantText)
+			if tt.wantIs != nil {
+				assert.Assert(t, errors.Is(err, tt.wantIs), err)
+			} else {
+				assert.Equal(t, errors.Unwrap(err), nil)
+			}
+		})
+	}
+}
+
+// FuzzProtocolError turns error replies into errors the way the client
+// does.
+func FuzzProtocolError(f *testing.F) {
+	for _, e := range sessionSeeds(f) {
+		if e.Error != nil {
+			f.Add([]byte(e.Error))
+		}
+	}
+	f.Add([]byte(`{"action":"get-logins","error":"","errorCode":"1000"}`))
+	f.Add([]byte(`{"action":"get-logins","error":"No logins found"}`))
+	f.Add([]byte(`{"action":"get-logins","error":"","errorCode":"-1"}`))
+
+	f.Fuzz(func(t *testing.T, reply []byte) {
+		var resp Response
+		if err := json.Unmarshal(reply, &resp); err != nil || resp.Error == nil {
+			return
+		}
+
+		err := protocolError(ActionGetLogins, *resp.Error, resp.Code)
+
+		var pe *ProtocolError
+		assert.Assert(t, errors.As(err, &pe), err)
+		assert.Assert(t, err.Error() != "")
+		if *resp.Error != "" {
+			assert.Equal(t, err.Error(), *resp.Error)
+		}
+
+		code := CodeUnknownError
+		if resp.Code != nil {
+			code = *resp.Code
+		}
+		assert.Equal(t, pe.Code, code)
+		assert.Equal(t, errors.Unwrap(err), codeError(code))
+	})
+}
+
+func TestClient_GetDatabaseHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    string
+		wantHash string
+		wantErr  error
+	}{
+		{"ok", `{"hash":"29234e32274a32276e25666a42","success":"true"}`, "29234e32274a32276e25666a42", nil},
+		{"missing hash", `{"success":"true"}`, "", ErrDatabaseHashNotReceived},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newMockClient(t, ActionGetDatabaseHash, tt.reply)
+
+			hash, err := c.GetDatabaseHash(false)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tt.wantErr)
+			}
+			if hash != tt.wantHash {
+				t.Errorf("got hash %q, want %q", hash, tt.wantHash)
+			}
+		})
+	}
+}
+
+func TestClient_LockDatabase(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    int
+		wantErr error
+	}{
+		{"locked", CodeDatabaseNotOpened, nil},
+		{"no hash", CodeDatabaseHashNotReceived, nil},
+		{"other error", CodeActionCancelledOrDenied, ErrActionCancelledOrDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newMockKeePass(func(c net.Conn) {
+				defer c.Close()
+
+				var req Request
+				if err := json.NewDecoder(c).Decode(&req); err != nil {
+					t.Error(err)
+				}
+				if req.Action != ActionLockDatabase {
+					t.Errorf("bad request: %+v", req)
+				}
+				msg, code := "error", tt.code
+				err := json.NewEncoder(c).Encode(Response{Error: &msg, Code: &code})
+				if err != nil {
+					t.Error(err)
+				}
+			})
+			defer k.Close()
+
+			c, err := New(k.Transport(), nil, nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = c.LockDatabase()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClient_GetDatabaseGroups(t *testing.T) {
+	reply := `{
+		"defaultGroup": "",
+		"defaultGroupAlwaysAllow": false,
+		"groups": {"groups": [{
+			"name": "Root",
+			"uuid": "a",
+			"children": [
+				{"name": "Work", "uuid": "b", "children": [{"name": "Infra", "uuid": "c", "children": []}]},
+				{"name": "Home", "uuid": "d", "children": []}
+			]
+		}]},
+		"success": "true"
+	}`
+	want := []Group{{
+		Name: "Root",
+		UUID: "a",
+		Children: []Group{
+			{Name: "Work", UUID: "b", Children: []Group{{Name: "Infra", UUID: "c", Children: []Group{}}}},
+			{Name: "Home", UUID: "d", Children: []Group{}},
+		},
+	}}
+
+	c, _ := newMockClient(t, ActionGetDatabaseGroups, reply)
+
+	resp, err := c.GetDatabaseGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, resp.Groups.Groups, want)
+}
+
+func TestClient_CreateNewGroup(t *testing.T) {
+	c, msgs := newMockClient(t, ActionCreateNewGroup, `{"name":"Infra","uuid":"c","success":"true"}`)
+
+	resp, err := c.CreateNewGroup("Work/Infra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Name != "Infra" || resp.UUID != "c" {
+		t.Errorf("bad response: %+v", resp)
+	}
+
+	var req CreateNewGroupRequest
+	if err := json.Unmarshal(<-msgs, &req); err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, req, CreateNewGroupRequest{Action: ActionCreateNewGroup, GroupName: "Work/Infra"})
+}
+
+func TestClient_DeleteEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		wantErr error
+	}{
+		{"deleted", `{"success":"true"}`, nil},
+		{"not deleted", `{"success":"false"}`, ErrEntryNotDeleted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, msgs := newMockClient(t, ActionDeleteEntry, tt.reply)
+
+			_, err := c.DeleteEntry("d1e6cba53ad04e8fb23f2991c160ce5a")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tt.wantErr)
+			}
+
+			var req DeleteEntryRequest
+			if err := json.Unmarshal(<-msgs, &req); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, req.UUID, "d1e6cba53ad04e8fb23f2991c160ce5a")
+		})
+	}
+}
+
+func TestClient_RequestAutotype(t *testing.T) {
+	c, msgs := newMockClient(t, ActionRequestAutotype, `{"success":"true"}`)
+
+	if _, err := c.RequestAutotype("example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	var req RequestAutotypeRequest
+	if err := json.Unmarshal(<-msgs, &req); err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, req, RequestAutotypeRequest{Action: ActionRequestAutotype, Search: "example.com"})
+}
+
+func TestClient_PasskeysGet(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    PublicKeyCredentialAssertion
+		wantErr error
+	}{
+		{
+			name: "assertion",
+			reply: `{"response":{"authenticatorAttachment":"platform","id":"Y3JlZA","rawId":"Y3JlZA",` +
+				`"response":{"authenticatorData":"YXV0aA","clientDataJSON":"ZGF0YQ","signature":"c2ln","userHandle":"dXNlcg"},` +
+				`"type":"public-key"},"success":"true"}`,
+			want: PublicKeyCredentialAssertion{
+				ID:                      "Y3JlZA",
+				RawID:                   "Y3JlZA",
+				Type:                    "public-key",
+				AuthenticatorAttachment: "platform",
+				Response: AuthenticatorAssertionResponse{
+					ClientDataJSON:    "ZGF0YQ",
+					AuthenticatorData: "YXV0aA",
+					Signature:         "c2ln",
+					UserHandle:        "dXNlcg",
+				},
+			},
+		},
+		{
+			name:    "canceled",
+			reply:   `{"response":{"errorCode":22},"success":"true"}`,
+			wantErr: ErrPasskeysRequestCanceled,
+		},
+		{
+			name:    "string code",
+			reply:   `{"response":{"errorCode":"26"},"success":"true"}`,
+			wantErr: ErrPasskeysOriginNotAllowed,
+		},
+		{
+			name:    "no response",
+			reply:   `{"success":"true"}`,
+			wantErr: ErrEmptyMessageReceived,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, msgs := newMockClient(t, ActionPasskeysGet, tt.reply)
+
+			opts := PublicKeyCredentialRequestOptions{Challenge: "Y2hhbGxlbmdl", RPID: "example.com"}
+			resp, err := c.PasskeysGet(opts, "https://example.com")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tt.wantErr)
+			}
+			assert.DeepEqual(t, resp.Credential, tt.want)
+
+			var req PasskeysGetRequest
+			if err := json.Unmarshal(<-msgs, &req); err != nil {
+				t.Fatal(err)
+			}
+			assert.DeepEqual(t, req.PublicKey, opts)
+			assert.Equal(t, req.Origin, "https://example.com")
+		})
+	}
+}
+
+func TestClient_PasskeysRegister(t *testing.T) {
+	reply := `{"response":{"authenticatorAttachment":"platform","id":"Y3JlZA","rawId":"Y3JlZA",` +
+		`"response":{"attestationObject":"b2JqZWN0","clientDataJSON":"ZGF0YQ"},"type":"public-key"},"success":"true"}`
+	c, msgs := newMockClient(t, ActionPasskeysRegister, reply)
+
+	opts := PublicKeyCredentialCreationOptions{
+		RP:               PublicKeyCredentialRPEntity{ID: "example.com", Name: "Example"},
+		User:             PublicKeyCredentialUserEntity{ID: "dXNlcg", Name: "user", DisplayName: "User"},
+		Challenge:        "Y2hhbGxlbmdl",
+		PubKeyCredParams: []PublicKeyCredentialParameters{{Type: "public-key", Alg: -7}},
+	}
+	resp, err := c.PasskeysRegister(opts, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, resp.Credential.Response, AuthenticatorAttestationResponse{
+		ClientDataJSON:    "ZGF0YQ",
+		AttestationObject: "b2JqZWN0",
+	})
+
+	var req PasskeysRegisterRequest
+	if err := json.Unmarshal(<-msgs, &req); err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, req.PublicKey, opts)
+}
+
+func TestClient_GetLogins(t *testing.T) {
+	tests := []struct {
+		name string
+		opts GetLoginsOptions
+		want GetLoginsRequest
+	}{
+		{
+			name: "url only",
+			want: GetLoginsRequest{URL: "https://example.com"},
+		},
+		{
+			name: "submit url and http auth",
+			opts: GetLoginsOptions{SubmitURL: "https://example.com/login", HTTPAuth: true},
+			want: GetLoginsRequest{URL: "https://example.com", SubmitURL: "https://example.com/login", HTTPAuth: "true"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := `{"count":1,"entries":[{"login":"user","name":"example","password":"pass","uuid":"a"}],"success":"true"}`
+			c, msgs := newMockClient(t, ActionGetLogins, reply)
+			c.SetAssociation([]byte("idkey"), "kpxcpc")
+
+			resp, err := c.GetLogins("https://example.com", tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.DeepEqual(t, resp.Entries, []LoginEntry{{Login: "user", Name: "example", Password: "pass", UUID: "a", Database: "kpxcpc"}})
+
+			var got GetLoginsRequest
+			if err := json.Unmarshal(<-msgs, &got); err != nil {
+				t.Fatal(err)
+			}
+			idKey := [24]byte{}
+			copy(idKey[:], "idkey")
+			tt.want.Action = ActionGetLogins
+			tt.want.Keys = []DBKey{{ID: "kpxcpc", Key: idKey[:]}}
+			assert.DeepEqual(t, got, tt.want)
+		})
+	}
+}
+
+func TestClient_GetLogins_multipleDatabases(t *testing.T) {
+	c := newMockClientFunc(t, func(req Request, msg []byte) interface{} {
+		var m GetLoginsRequest
+		if err := json.Unmarshal(msg, &m); err != nil || len(m.Keys) != 1 {
+			t.Errorf("bad request: %s", msg)
+		}
+
+		switch m.Keys[0].ID {
+		case "work":
+			return `{"count":1,"entries":[{"login":"alice","uuid":"a"}],"success":"true"}`
+		case "infra":
+			return `{"count":1,"entries":[{"login":"root","uuid":"b"}],"success":"true"}`
+		case "locked":
+			msg, code := "Database not opened", CodeDatabaseNotOpened
+			return Response{Error: &msg, Code: &code}
+		default:
+			msg, code := "No logins found", CodeNoLoginsFound
+			return Response{Error: &msg, Code: &code}
+		}
+	})
+	c.SetAssociation([]byte("work key"), "work")
+	c.AddAssociation([]byte("closed key"), "closed")
+	c.AddAssociation([]byte("locked key"), "locked")
+	c.AddAssociation([]byte("infra key"), "infra")
+
+	resp, err := c.GetLogins("https://example.com", GetLoginsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, resp.Entries, []LoginEntry{
+		{Login: "alice", UUID: "a", Database: "work"},
+		{Login: "root", UUID: "b", Database: "infra"},
+	})
+	assert.Equal(t, resp.Count, 2)
+}
+
+func TestClient_GetLogins_failingDatabases(t *testing.T) {
+	c := newMockClientFunc(t, func(req Request, msg []byte) interface{} {
+		var m GetLoginsRequest
+		if err := json.Unmarshal(msg, &m); err != nil || len(m.Keys) != 1 {
+			t.Errorf("bad request: %s", msg)
+		}
+
+		text, code := "No logins found", CodeNoLoginsFound
+		if m.Keys[0].ID == "locked" {
+			text, code = "Database not opened", CodeDatabaseNotOpened
+		}
+		return Response{Error: &text, Code: &code}
+	})
+	c.SetAssociation([]byte("work key"), "work")
+	c.AddAssociation([]byte("locked key"), "locked")
+
+	// Without entries, the error of the failed database is returned
+	// rather than "no logins found".
+	_, err := c.GetLogins("https://example.com", GetLoginsOptions{})
+	assert.Assert(t, errors.Is(err, ErrDatabaseNotOpened), err)
+	assert.ErrorContains(t, err, "database locked: ")
+}
@@ -24,6 +24,9 @@
 package kpclient
 
 import (
+	"bytes"
+	"encoding/json"
+	"math/big"
 	"testing"
 
 	"gotest.tools/assert"
@@ -51,3 +54,43 @@ func Test_incrementNonce(t *testing.T) {
 		})
 	}
 }
+
+// FuzzIncrementNonce checks incrementNonce against big-integer arithmetic:
+// a nonce is a little-endian number that wraps around.
+func FuzzIncrementNonce(f *testing.F) {
+	f.Add([]byte("aaaaaaaaaaaaaaaaaaaaaaaa"))
+	f.Add(bytes.Repeat([]byte{0xff}, 24))
+	f.Add([]byte{0xff, 0xff, 0x00})
+	for _, e := range sessionSeeds(f) {
+		var m struct {
+			Nonce []byte `json:"nonce"`
+		}
+		if json.Unmarshal(e.Reply, &m) == nil && m.Nonce != nil {
+			f.Add(m.Nonce)
+		}
+	}
+
+	mod := new(big.Int).Lsh(big.NewInt(1), 24*8)
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var nonce [24]byte
+		copy(nonce[:], b)
+		orig := nonce
+
+		got := incrementNonce(&nonce)
+		assert.DeepEqual(t, nonce, orig) // the argument isn't modified
+
+		want := new(big.Int).SetBytes(reverse(nonce[:]))
+		want.Add(want, big.NewInt(1)).Mod(want, mod)
+		assert.DeepEqual(t, reverse(got[:]), want.FillBytes(make([]byte, 24)))
+	})
+}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+
+	return r
+}
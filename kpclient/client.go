@@ -24,33 +24,90 @@
 package kpclient
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"io"
-	"net"
+	"log"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/nacl/box"
 )
 
-var ErrFailedToOpen = errors.New("failed to open message")
+var (
+	ErrFailedToOpen = errors.New("failed to open message")
 
+	// ErrNonceMismatch is returned when a reply doesn't carry the incremented
+	// nonce of the request, e.g. because it was replayed.
+	ErrNonceMismatch = errors.New("response nonce doesn't match the request")
+)
+
+// eventBufferSize is the number of events kept for a client that doesn't
+// read them. Newer events are dropped when the buffer is full.
+const eventBufferSize = 16
+
+// Event is a notification KeePassXC sends without being asked,
+// e.g. ActionDatabaseLocked.
+type Event struct {
+	Action string    `json:"action"`
+	Time   time.Time `json:"time"` // time the event was received
+}
+
+// Client is a KeePassXC browser protocol client. It is safe for concurrent
+// use: requests from several goroutines are sent without waiting for each
+// other and the replies are matched to them by nonce.
 type Client struct {
-	conn         net.Conn
-	privkey      [32]byte
-	pubkey       [32]byte
-	serverPubkey [32]byte
-	clientID     [24]byte
-	lastNonce    *[24]byte
+	transport Transport
+	privkey   [32]byte
+	pubkey    [32]byte
+	clientID  [24]byte
 
 	rand io.Reader
 
+	mu           sync.Mutex // guards the fields below
+	serverPubkey [32]byte
+	lastNonce    *[24]byte
+
 	// Association (should be saved/loaded)
 	idKey      [24]byte // client identifier key
 	identifier string   // user-set identifier
+
+	// Associations with other databases, used by GetLogins and passkeys.
+	associations []DBKey
+
+	version string // KeePassXC version, see ServerVersion
+
+	callsMu sync.Mutex // guards the fields below
+	calls   []*call    // requests waiting for a reply, oldest first
+	readErr error      // set once the connection is closed
+
+	writeMu sync.Mutex // serializes writes to the transport
+
+	optsMu   sync.Mutex // guards the fields below
+	retry    RetryPolicy
+	logger   *log.Logger
+	observer Observer
+
+	events chan Event
+}
+
+// call is a request waiting for its reply.
+type call struct {
+	action    string
+	nonce     [24]byte    // nonce the reply is expected to have
+	reply     chan []byte // closed if the connection is closed first
+	abandoned bool        // the caller stopped waiting, the reply is dropped
 }
 
-func New(conn net.Conn, randReader io.Reader, idKey []byte, clientIdentifier string) (*Client, error) {
+// writeDeadliner is implemented by transports that can time out writes.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+func New(transport Transport, randReader io.Reader, idKey []byte, clientIdentifier string) (*Client, error) {
 	if randReader == nil {
 		randReader = rand.Reader
 	}
@@ -76,8 +133,8 @@ func New(conn net.Conn, randReader io.Reader, idKey []byte, clientIdentifier str
 	}
 	copy(idKeyArray[:], idKey)
 
-	return &Client{
-		conn:       conn,
+	c := &Client{
+		transport:  transport,
 		privkey:    *privkey,
 		pubkey:     *pubkey,
 		clientID:   *clientID,
@@ -85,75 +142,416 @@ func New(conn net.Conn, randReader io.Reader, idKey []byte, clientIdentifier str
 		rand:       randReader,
 		idKey:      *idKeyArray,
 		identifier: clientIdentifier,
-	}, nil
+		events:     make(chan Event, eventBufferSize),
+		retry:      DefaultRetryPolicy,
+	}
+
+	if o, ok := transport.(Observer); ok {
+		c.observer = o
+	}
+
+	if transport != nil {
+		go c.readLoop()
+	}
+
+	return c, nil
+}
+
+// Close closes the connection. The events channel is closed once the
+// connection is.
+func (c *Client) Close() error {
+	return c.transport.Close()
+}
+
+// SetRetryPolicy sets how requests failing with a transient error are
+// retried. Clients use DefaultRetryPolicy unless it is set.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.optsMu.Lock()
+	defer c.optsMu.Unlock()
+
+	c.retry = p
+}
+
+// RetryPolicy returns the retry policy used by the client.
+func (c *Client) RetryPolicy() RetryPolicy {
+	c.optsMu.Lock()
+	defer c.optsMu.Unlock()
+
+	return c.retry
+}
+
+// WaitRetry is like RetryPolicy().Wait, but it also logs the retry to the
+// client's logger. what describes the operation that failed, for example
+// "key exchange".
+func (c *Client) WaitRetry(ctx context.Context, what string, attempt int, err error) error {
+	return c.waitRetry(ctx, c.RetryPolicy(), what, attempt, err)
 }
 
+func (c *Client) waitRetry(ctx context.Context, p RetryPolicy, what string, attempt int, err error) error {
+	if attempt < p.attempts() {
+		c.logf("debug: %s failed (attempt %d of %d), retrying in %v: %v",
+			what, attempt, p.attempts(), p.Delay(attempt), err)
+	}
+
+	return p.Wait(ctx, attempt, err)
+}
+
+// SetLogger sets the logger for debug messages such as retries.
+// Nothing is logged if it is nil, which is the default.
+func (c *Client) SetLogger(l *log.Logger) {
+	c.optsMu.Lock()
+	defer c.optsMu.Unlock()
+
+	c.logger = l
+}
+
+func (c *Client) logf(format string, v ...interface{}) {
+	c.optsMu.Lock()
+	l := c.logger
+	c.optsMu.Unlock()
+
+	if l != nil {
+		l.Printf(format, v...)
+	}
+}
+
+// SetObserver sets the observer notified of every exchange with KeePassXC.
+// If the transport passed to New is an Observer, such as a Recorder, it is
+// used unless replaced.
+func (c *Client) SetObserver(o Observer) {
+	c.optsMu.Lock()
+	defer c.optsMu.Unlock()
+
+	c.observer = o
+}
+
+func (c *Client) observe(e Exchange) {
+	c.optsMu.Lock()
+	o := c.observer
+	c.optsMu.Unlock()
+
+	if o != nil {
+		o.Observe(e)
+	}
+}
+
+// Events returns the channel of notifications sent by KeePassXC, such as
+// database being locked or unlocked. It is closed when the connection is.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// readLoop reads messages from the connection, passing notifications to
+// the events channel and replies to the requests waiting for them.
+func (c *Client) readLoop() {
+	for {
+		msg, err := c.transport.Receive()
+		if err != nil {
+			c.callsMu.Lock()
+			c.readErr = err
+			for _, cl := range c.calls {
+				close(cl.reply)
+			}
+			c.calls = nil
+			c.callsMu.Unlock()
+
+			close(c.events)
+			return
+		}
+
+		var m struct {
+			Action string `json:"action"`
+			Nonce  []byte `json:"nonce"`
+		}
+		_ = json.Unmarshal(msg, &m)
+
+		if isNotification(m.Action) {
+			select {
+			case c.events <- Event{Action: m.Action, Time: time.Now()}:
+			default:
+			}
+			continue
+		}
+
+		c.callsMu.Lock()
+		if cl := c.popCall(m.Action, m.Nonce); cl != nil && !cl.abandoned {
+			cl.reply <- msg
+		}
+		c.callsMu.Unlock()
+	}
+}
+
+// popCall removes and returns the request a reply belongs to. Replies are
+// matched by nonce. Error replies carry no nonce, so they are matched to
+// the oldest request with the same action, or the oldest request if there
+// is none. c.callsMu must be held.
+func (c *Client) popCall(action string, nonce []byte) *call {
+	i := -1
+	if len(nonce) == len(call{}.nonce) {
+		for j, cl := range c.calls {
+			if bytes.Equal(cl.nonce[:], nonce) {
+				i = j
+				break
+			}
+		}
+	}
+
+	if i < 0 {
+		for j, cl := range c.calls {
+			if cl.action == action {
+				i = j
+				break
+			}
+		}
+	}
+
+	if i < 0 {
+		if len(c.calls) == 0 {
+			return nil
+		}
+		i = 0
+	}
+
+	cl := c.calls[i]
+	c.calls = append(c.calls[:i], c.calls[i+1:]...)
+
+	return cl
+}
+
+func isNotification(action string) bool {
+	return action == ActionDatabaseLocked || action == ActionDatabaseUnlocked
+}
+
+// nonce returns the nonce for the next request. The nonce after it is
+// reserved for the reply.
 func (c *Client) nonce() *[24]byte {
-	c.lastNonce = incrementNonce(c.lastNonce)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	return c.lastNonce
+	n := incrementNonce(c.lastNonce)
+	c.lastNonce = incrementNonce(n)
+
+	return n
 }
 
 func (c *Client) AssociationData() (idKey [24]byte, identifier string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	return c.idKey, c.identifier
 }
 
-func (c *Client) send(request, response interface{}) (err error) {
-	if err = json.NewEncoder(c.conn).Encode(request); err != nil {
+// SetAssociation replaces the association used by the client.
+func (c *Client) SetAssociation(idKey []byte, identifier string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.idKey = [24]byte{}
+	copy(c.idKey[:], idKey)
+	c.identifier = identifier
+}
+
+// AddAssociation adds an association with another database. Entries from
+// all associated databases are returned by GetLogins.
+func (c *Client) AddAssociation(idKey []byte, identifier string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := DBKey{ID: identifier, Key: make([]byte, len(c.idKey))}
+	copy(k.Key, idKey)
+
+	for i := range c.associations {
+		if c.associations[i].ID == identifier {
+			c.associations[i] = k
+			return
+		}
+	}
+
+	c.associations = append(c.associations, k)
+}
+
+// Associations returns the keys of all databases the client is associated
+// with, starting with the one set by New, SetAssociation or Associate.
+func (c *Client) Associations() []DBKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]DBKey, 0, len(c.associations)+1)
+	if c.identifier != "" {
+		keys = append(keys, DBKey{ID: c.identifier, Key: append([]byte{}, c.idKey[:]...)})
+	}
+
+	for _, k := range c.associations {
+		if k.ID != c.identifier {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// send sends a request with the given action and nonce and waits for its
+// reply. It returns the request and the reply as sent and received.
+func (c *Client) send(
+	ctx context.Context, action string, nonce *[24]byte, request, response interface{},
+) (sent, reply []byte, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	sent, err = json.Marshal(request)
+	if err != nil {
+		return
+	}
+
+	cl := &call{action: action, nonce: *incrementNonce(nonce), reply: make(chan []byte, 1)}
+
+	c.callsMu.Lock()
+	if c.readErr != nil {
+		c.callsMu.Unlock()
+		return sent, nil, c.readErr
+	}
+	c.calls = append(c.calls, cl)
+	c.callsMu.Unlock()
+
+	if err = c.write(ctx, sent); err != nil {
+		c.callsMu.Lock()
+		for i := range c.calls {
+			if c.calls[i] == cl {
+				c.calls = append(c.calls[:i], c.calls[i+1:]...)
+				break
+			}
+		}
+		c.callsMu.Unlock()
+
+		if ctx.Err() != nil {
+			return sent, nil, ctx.Err()
+		}
 		return
 	}
 
-	return json.NewDecoder(c.conn).Decode(response)
+	select {
+	case msg, ok := <-cl.reply:
+		if !ok {
+			c.callsMu.Lock()
+			defer c.callsMu.Unlock()
+			return sent, nil, c.readErr
+		}
+		return sent, msg, json.Unmarshal(msg, response)
+	case <-ctx.Done():
+		// The reply is still matched when it arrives, so that it isn't
+		// taken for the reply to another request.
+		c.callsMu.Lock()
+		cl.abandoned = true
+		c.callsMu.Unlock()
+		return sent, nil, ctx.Err()
+	}
 }
 
-func (c *Client) sendMessageWithRetry(action string, message, response interface{}, triggerUnlock bool) (err error) {
-	for {
-		err = c.sendMessage(action, message, response, triggerUnlock)
+func (c *Client) write(ctx context.Context, b []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 
-		// TODO: find out why we can't open the response sometimes.
-		// We obviously exchanged pubkeys and verified association successfully already.
-		// A retry usually fixes this.
-		if errors.Is(err, ErrFailedToOpen) {
-			continue
+	if d, ok := ctx.Deadline(); ok {
+		if t, ok := c.transport.(writeDeadliner); ok {
+			if err := t.SetWriteDeadline(d); err != nil {
+				return err
+			}
+			defer t.SetWriteDeadline(time.Time{}) // nolint:errcheck
 		}
+	}
+
+	return c.transport.Send(b)
+}
 
+func (c *Client) sendMessageWithRetry(
+	ctx context.Context, action string, message, response interface{}, triggerUnlock bool,
+) (err error) {
+	if err = c.checkSupported(action); err != nil {
 		return
 	}
+
+	p := c.RetryPolicy()
+
+	for attempt := 1; ; attempt++ {
+		err = c.sendMessage(ctx, action, message, response, triggerUnlock)
+		if err == nil || !p.retryable(err) || ctx.Err() != nil {
+			return
+		}
+
+		if err = c.waitRetry(ctx, p, action, attempt, err); err != nil {
+			return
+		}
+	}
 }
 
-func (c *Client) sendMessage(action string, message, response interface{}, triggerUnlock bool) (err error) {
+func (c *Client) sendMessage(
+	ctx context.Context, action string, message, response interface{}, triggerUnlock bool,
+) (err error) {
 	msg, err := json.Marshal(message)
 	if err != nil {
 		return
 	}
 
 	nonce := c.nonce()
+	serverPubkey := c.serverKey()
 
 	req := Request{
 		ClientID:      c.clientID[:],
 		Action:        action,
 		TriggerUnlock: triggerUnlock,
 		Nonce:         nonce[:],
-		Message:       box.Seal([]byte{}, msg, nonce, &c.serverPubkey, &c.privkey),
+		Message:       box.Seal([]byte{}, msg, nonce, &serverPubkey, &c.privkey),
 	}
 
+	e := Exchange{Action: action, Request: msg, Start: time.Now()}
+	defer func() {
+		e.Duration = time.Since(e.Start)
+		e.Err = err
+		c.observe(e)
+	}()
+
 	var resp Response
-	if err = c.send(req, &resp); err != nil {
+	e.Sent, e.Received, err = c.send(ctx, action, nonce, req, &resp)
+	if err != nil {
 		return
 	}
+	reply := e.Received
 
 	if resp.Error != nil {
-		return protocolError(*resp.Error, *resp.Code)
+		e.Error = reply
+		return protocolError(action, *resp.Error, resp.Code)
 	}
 
-	n := &[24]byte{}
-	copy(n[:], resp.Nonce)
-	c.lastNonce = n
+	n, err := checkNonce(nonce, resp.Nonce)
+	if err != nil {
+		return
+	}
 
-	b, ok := box.Open([]byte{}, resp.Message, n, &c.serverPubkey, &c.privkey)
+	b, ok := box.Open([]byte{}, resp.Message, n, &serverPubkey, &c.privkey)
 	if !ok {
 		return ErrFailedToOpen
 	}
+	e.Reply = b
+	c.setVersionFrom(b)
 
 	return json.Unmarshal(b, response)
 }
+
+func (c *Client) serverKey() [32]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.serverPubkey
+}
+
+// checkNonce returns the nonce a reply to a request with the given nonce
+// must have, or ErrNonceMismatch if it has a different one.
+func checkNonce(request *[24]byte, reply []byte) (*[24]byte, error) {
+	n := incrementNonce(request)
+	if !bytes.Equal(n[:], reply) {
+		return nil, ErrNonceMismatch
+	}
+
+	return n, nil
+}
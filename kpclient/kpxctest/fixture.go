@@ -0,0 +1,142 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpxctest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"os"
+	"strings"
+
+	"gitlab.com/nwwdles/kpxcpc/kpclient"
+)
+
+// Entry is a database entry.
+type Entry struct {
+	UUID     string `json:"uuid"`
+	Name     string `json:"name"`
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	URL      string `json:"url"`
+	Group    string `json:"group,omitempty"` // UUID of the group the entry is in
+	TOTP     string `json:"totp,omitempty"`  // code returned by get-totp
+
+	// StringFields are custom fields such as "KPH: otp".
+	StringFields map[string]string `json:"stringFields,omitempty"`
+}
+
+// Fixture is the content of the database served by a Server.
+type Fixture struct {
+	Hash    string           `json:"hash"`
+	Groups  []kpclient.Group `json:"groups"`
+	Entries []Entry          `json:"entries"`
+}
+
+// LoadFixture reads a JSON encoded Fixture from a file.
+func LoadFixture(path string) (*Fixture, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f Fixture
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// newUUID returns a random UUID formatted the way KeePassXC does.
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// matchURL reports whether an entry URL matches the URL of a request.
+// Like KeePassXC, entries are matched by host.
+func matchURL(entryURL, requestURL string) bool {
+	return entryURL != "" && host(entryURL) == host(requestURL)
+}
+
+func host(s string) string {
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+
+	return strings.ToLower(u.Hostname())
+}
+
+// createGroup creates the groups on a slash-separated path in the root
+// group, if they don't exist, and returns the last one.
+func createGroup(groups *[]kpclient.Group, path string) *kpclient.Group {
+	if len(*groups) == 0 {
+		*groups = append(*groups, kpclient.Group{Name: "Root", UUID: newUUID()})
+	}
+
+	g := &(*groups)[0]
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+
+		i := 0
+		for ; i < len(g.Children); i++ {
+			if g.Children[i].Name == name {
+				break
+			}
+		}
+		if i == len(g.Children) {
+			g.Children = append(g.Children, kpclient.Group{Name: name, UUID: newUUID()})
+		}
+		g = &g.Children[i]
+	}
+
+	return g
+}
+
+// findGroup returns the group with the given name or UUID.
+func findGroup(groups []kpclient.Group, nameOrUUID string) *kpclient.Group {
+	for i := range groups {
+		if groups[i].UUID == nameOrUUID || groups[i].Name == nameOrUUID {
+			return &groups[i]
+		}
+		if g := findGroup(groups[i].Children, nameOrUUID); g != nil {
+			return g
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpxctest
+
+import (
+	"encoding/json"
+	"os"
+
+	"gitlab.com/nwwdles/kpxcpc/kpclient"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// LoadSession reads a session written by kpclient.Recorder.
+func LoadSession(path string) (kpclient.Session, error) {
+	var s kpclient.Session
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+
+	err = json.Unmarshal(b, &s)
+
+	return s, err
+}
+
+// NewReplayServer returns a server that answers requests with the replies
+// recorded in a session instead of using a database. Each request gets the
+// next recorded reply for its action. Keys are exchanged as usual, so the
+// recorded keys don't matter.
+func NewReplayServer(session kpclient.Session) *Server {
+	s := NewServer(nil)
+	s.replay = map[string][]kpclient.Exchange{}
+
+	for _, e := range session.Exchanges {
+		if e.Action == kpclient.ActionChangePublicKeys {
+			var r struct {
+				Version string `json:"version"`
+			}
+			if json.Unmarshal(e.Reply, &r) == nil && r.Version != "" {
+				s.Version = r.Version
+			}
+			continue
+		}
+
+		s.replay[e.Action] = append(s.replay[e.Action], e)
+	}
+
+	return s
+}
+
+// Unreplayed returns the number of recorded replies that weren't sent yet.
+func (s *Server) Unreplayed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, q := range s.replay {
+		n += len(q)
+	}
+
+	return n
+}
+
+// replayMessage returns the next recorded reply for a request.
+func (s *Server) replayMessage(c *conn, req kpclient.Request, nonce *[24]byte) interface{} {
+	s.mu.Lock()
+	err := s.injectedError(req.Action)
+	q := s.replay[req.Action]
+	if err == nil && len(q) > 0 {
+		s.replay[req.Action] = q[1:]
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		return errorReply(req.Action, err)
+	}
+	if len(q) == 0 {
+		return errorReply(req.Action, &kpclient.ProtocolError{
+			Code:    kpclient.CodeIncorrectAction,
+			Message: "no recorded reply for " + req.Action,
+		})
+	}
+
+	e := q[0]
+	if e.Error != nil {
+		return e.Error
+	}
+
+	// The recorded nonce belongs to the recorded request.
+	var body map[string]interface{}
+	if err := json.Unmarshal(e.Reply, &body); err != nil {
+		return errorReply(req.Action, fail(kpclient.CodeEmptyMessageReceived))
+	}
+	body["nonce"] = nonce[:]
+	b, err := json.Marshal(body)
+	if err != nil {
+		return errorReply(req.Action, fail(kpclient.CodeEmptyMessageReceived))
+	}
+
+	return map[string]interface{}{
+		"action":  req.Action,
+		"message": box.Seal(nil, b, nonce, c.clientPubkey, c.privkey),
+		"nonce":   nonce[:],
+	}
+}
@@ -0,0 +1,149 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpxctest_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/nwwdles/kpxcpc/kpclient"
+	"gitlab.com/nwwdles/kpxcpc/kpclient/kpxctest"
+	"gotest.tools/assert"
+)
+
+func newReplayClient(t *testing.T, session kpclient.Session) (*kpxctest.Server, *kpclient.Client) {
+	t.Helper()
+
+	s := kpxctest.NewReplayServer(session)
+	t.Cleanup(func() { s.Close() })
+
+	c, err := kpclient.New(s.Connect(), nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return s, c
+}
+
+// TestReplayServer replays kpxctest-session.json, which was recorded with
+// kpxcpc -record against a Server, not against a real KeePassXC. It tests
+// the replay itself and doesn't pin down how KeePassXC behaves.
+func TestReplayServer(t *testing.T) {
+	session, err := kpxctest.LoadSession(filepath.Join("testdata", "kpxctest-session.json"))
+	assert.NilError(t, err)
+
+	s, c := newReplayClient(t, session)
+	assert.Equal(t, s.Version, kpxctest.DefaultVersion)
+
+	_, err = c.ChangePublicKeys()
+	assert.NilError(t, err)
+
+	hash, err := c.GetDatabaseHash(true)
+	assert.NilError(t, err)
+	assert.Equal(t, hash, "29234e32274a32276e25666a42")
+
+	_, err = c.Associate()
+	assert.NilError(t, err)
+	_, id := c.AssociationData()
+	assert.Equal(t, id, "kpxctest 1")
+
+	_, err = c.TestAssociate(true)
+	assert.NilError(t, err)
+
+	logins, err := c.GetLogins("https://example.com", kpclient.GetLoginsOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, logins.Count, 2)
+	assert.Equal(t, logins.Entries[0].Login, "elon")
+	assert.Equal(t, logins.Entries[0].Password, kpclient.Redacted)
+
+	_, err = c.GetLogins("https://nothing.example.com", kpclient.GetLoginsOptions{})
+	assert.Assert(t, errors.Is(err, kpclient.ErrNoLoginsFound), err)
+
+	totp, err := c.GetTOTP("d1e6cba53ad04e8fb23f2991c160ce5a")
+	assert.NilError(t, err)
+	assert.Equal(t, totp.TOTP, kpclient.Redacted)
+
+	groups, err := c.GetDatabaseGroups()
+	assert.NilError(t, err)
+	assert.Equal(t, groups.Groups.Groups[0].Name, "Root")
+
+	// Replies are served in order for each action.
+	_, err = c.LockDatabase()
+	assert.NilError(t, err)
+	_, err = c.GetLogins("https://example.com", kpclient.GetLoginsOptions{})
+	assert.Assert(t, errors.Is(err, kpclient.ErrDatabaseNotOpened), err)
+
+	// There's nothing left to replay for get-logins.
+	_, err = c.GetLogins("https://example.com", kpclient.GetLoginsOptions{})
+	assert.Assert(t, errors.Is(err, kpclient.ErrIncorrectAction), err)
+
+	// generate-password, create-new-group, set-login and request-autotype.
+	assert.Equal(t, s.Unreplayed(), 4)
+}
+
+// TestReplayServer_recorded replays a session recorded from a Server.
+func TestReplayServer_recorded(t *testing.T) {
+	s := newServer(t)
+	r := kpclient.NewRecorder(s.Connect())
+	c, err := kpclient.New(r, nil, nil, "")
+	assert.NilError(t, err)
+	defer c.Close()
+
+	_, err = c.ChangePublicKeys()
+	assert.NilError(t, err)
+	_, err = c.Associate()
+	assert.NilError(t, err)
+	want, err := c.GetLogins("https://example.com", kpclient.GetLoginsOptions{})
+	assert.NilError(t, err)
+	_, err = c.GetTOTP("d1e6cba53ad04e8fb23f2991c160ce5a")
+	assert.NilError(t, err)
+
+	var b bytes.Buffer
+	assert.NilError(t, r.WriteSession(&b))
+	var session kpclient.Session
+	assert.NilError(t, json.Unmarshal(b.Bytes(), &session))
+
+	rs, rc := newReplayClient(t, session)
+	_, err = rc.ChangePublicKeys()
+	assert.NilError(t, err)
+	_, err = rc.Associate()
+	assert.NilError(t, err)
+	got, err := rc.GetLogins("https://example.com", kpclient.GetLoginsOptions{})
+	assert.NilError(t, err)
+
+	for i := range want.Entries {
+		want.Entries[i].Password = kpclient.Redacted
+		for _, f := range want.Entries[i].StringFields {
+			for k := range f {
+				f[k] = kpclient.Redacted
+			}
+		}
+	}
+	assert.DeepEqual(t, got.Entries, want.Entries)
+	assert.Equal(t, rs.Unreplayed(), 1)
+}
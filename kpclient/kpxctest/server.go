@@ -0,0 +1,696 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpxctest
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"gitlab.com/nwwdles/kpxcpc/kpclient"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// DefaultVersion is the KeePassXC version reported by servers.
+const DefaultVersion = "2.7.9"
+
+// DefaultPassword is returned by generate-password.
+const DefaultPassword = "kpxctest-generated-password"
+
+// Server is a fake KeePassXC. Its exported fields must be set before the
+// first client connects.
+type Server struct {
+	// Version is the KeePassXC version sent in replies.
+	Version string
+
+	// GeneratedPassword is returned by generate-password.
+	GeneratedPassword string
+
+	// DenyAssociation makes association requests fail as if the user
+	// cancelled the dialog.
+	DenyAssociation bool
+
+	// UnlockOnTrigger makes a request with triggerUnlock unlock the
+	// database, as if the user typed the password right away.
+	UnlockOnTrigger bool
+
+	mu           sync.Mutex // guards the fields below
+	db           Fixture
+	locked       bool
+	associations map[string][]byte
+	errs         map[string][]int // injected error codes by action
+	autotype     []string
+	conns        map[*conn]struct{}
+	listeners    []net.Listener
+	closed       bool
+
+	// replay holds the recorded exchanges by action for servers returned
+	// by NewReplayServer.
+	replay map[string][]kpclient.Exchange
+}
+
+// conn is a connected client.
+type conn struct {
+	t       kpclient.Transport
+	writeMu sync.Mutex
+
+	// Keys from the last key exchange. They are only used by the goroutine
+	// serving the connection.
+	pubkey, privkey *[32]byte
+	clientPubkey    *[32]byte
+}
+
+func (c *conn) write(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return c.t.Send(b)
+}
+
+// NewServer returns a server with an unlocked database holding a copy of
+// the fixture, which may be nil.
+func NewServer(f *Fixture) *Server {
+	s := &Server{
+		Version:           DefaultVersion,
+		GeneratedPassword: DefaultPassword,
+		associations:      map[string][]byte{},
+		errs:              map[string][]int{},
+		conns:             map[*conn]struct{}{},
+	}
+
+	if f != nil {
+		// Copy the fixture, so that tests can reuse it.
+		b, err := json.Marshal(f)
+		if err == nil {
+			err = json.Unmarshal(b, &s.db)
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if s.db.Hash == "" {
+		s.db.Hash = newUUID()
+	}
+
+	return s
+}
+
+// Connect returns a transport connected to the server.
+func (s *Server) Connect() kpclient.Transport {
+	client, server := kpclient.Pipe()
+	go s.ServeTransport(server) // nolint:errcheck
+
+	return client
+}
+
+// Serve accepts connections on l, e.g. a unix socket listener, until the
+// server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.closed {
+				return nil
+			}
+			return err
+		}
+
+		go s.ServeTransport(kpclient.NewSocketTransport(c)) // nolint:errcheck
+	}
+}
+
+// ServeTransport answers requests from t until it is closed.
+func (s *Server) ServeTransport(t kpclient.Transport) error {
+	c := &conn{t: t}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		t.Close()
+		return net.ErrClosed
+	}
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		t.Close()
+	}()
+
+	for {
+		b, err := t.Receive()
+		if err != nil {
+			return nil // the client is gone
+		}
+
+		if err := c.write(s.handle(c, b)); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes all listeners and connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	var errs []error
+	for _, l := range s.listeners {
+		errs = append(errs, l.Close())
+	}
+	for c := range s.conns {
+		errs = append(errs, c.t.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// Lock locks the database and notifies connected clients.
+func (s *Server) Lock() {
+	s.mu.Lock()
+	conns := s.setLocked(true)
+	s.mu.Unlock()
+
+	notify(conns, kpclient.ActionDatabaseLocked)
+}
+
+// Unlock unlocks the database and notifies connected clients.
+func (s *Server) Unlock() {
+	s.mu.Lock()
+	conns := s.setLocked(false)
+	s.mu.Unlock()
+
+	notify(conns, kpclient.ActionDatabaseUnlocked)
+}
+
+// Locked reports whether the database is locked.
+func (s *Server) Locked() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.locked
+}
+
+// setLocked changes the lock state and returns the clients to notify if it
+// has changed. s.mu must be held.
+func (s *Server) setLocked(locked bool) []*conn {
+	if s.locked == locked {
+		return nil
+	}
+	s.locked = locked
+
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+
+	return conns
+}
+
+func notify(conns []*conn, action string) {
+	for _, c := range conns {
+		_ = c.write(map[string]string{"action": action})
+	}
+}
+
+// Hash returns the hash identifying the database.
+func (s *Server) Hash() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Hash
+}
+
+// AddAssociation associates a client identity with the database, as if
+// it had been associated before.
+func (s *Server) AddAssociation(id string, idKey []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.associations[id] = append([]byte{}, idKey...)
+}
+
+// Associations returns the identities associated with the database,
+// sorted by ID.
+func (s *Server) Associations() []kpclient.DBKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]kpclient.DBKey, 0, len(s.associations))
+	for id, key := range s.associations {
+		keys = append(keys, kpclient.DBKey{ID: id, Key: append([]byte{}, key...)})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	return keys
+}
+
+// Entries returns a copy of the database entries.
+func (s *Server) Entries() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Entry{}, s.db.Entries...)
+}
+
+// Groups returns a copy of the group tree.
+func (s *Server) Groups() []kpclient.Group {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var groups []kpclient.Group
+	b, _ := json.Marshal(s.db.Groups)
+	_ = json.Unmarshal(b, &groups)
+
+	return groups
+}
+
+// AutotypeRequests returns the search strings of auto-type requests.
+func (s *Server) AutotypeRequests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.autotype...)
+}
+
+// InjectError makes the next request with the action fail with the given
+// error code, e.g. kpclient.CodeCannotDecryptMessage. Errors injected for
+// the same action are used in order.
+func (s *Server) InjectError(action string, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.errs[action] = append(s.errs[action], code)
+}
+
+// injectedError returns the next error injected for the action, if any.
+// s.mu must be held.
+func (s *Server) injectedError(action string) error {
+	codes := s.errs[action]
+	if len(codes) == 0 {
+		return nil
+	}
+	s.errs[action] = codes[1:]
+
+	return fail(codes[0])
+}
+
+func fail(code int) error {
+	return &kpclient.ProtocolError{Code: code}
+}
+
+// errorReply returns the unencrypted reply KeePassXC sends on errors.
+func errorReply(action string, err error) interface{} {
+	code := kpclient.CodeUnknownError
+	var perr *kpclient.ProtocolError
+	if errors.As(err, &perr) {
+		code = perr.Code
+	}
+
+	return map[string]string{
+		"action":    action,
+		"error":     err.Error(),
+		"errorCode": strconv.Itoa(code),
+	}
+}
+
+// handle returns the reply to a request.
+func (s *Server) handle(c *conn, b []byte) interface{} {
+	var req kpclient.Request
+	if err := json.Unmarshal(b, &req); err != nil {
+		return errorReply("", fail(kpclient.CodeEmptyMessageReceived))
+	}
+
+	if req.Action == kpclient.ActionChangePublicKeys {
+		reply, err := s.changePublicKeys(c, b)
+		if err != nil {
+			return errorReply(req.Action, err)
+		}
+		return reply
+	}
+
+	if c.clientPubkey == nil {
+		return errorReply(req.Action, fail(kpclient.CodeClientPublicKeyNotReceived))
+	}
+
+	if len(req.Nonce) != 24 {
+		return errorReply(req.Action, fail(kpclient.CodeCannotDecryptMessage))
+	}
+	nonce := (*[24]byte)(req.Nonce)
+
+	msg, ok := box.Open(nil, req.Message, nonce, c.clientPubkey, c.privkey)
+	if !ok {
+		return errorReply(req.Action, fail(kpclient.CodeCannotDecryptMessage))
+	}
+
+	replyNonce := incrementNonce(nonce)
+	if s.replay != nil {
+		return s.replayMessage(c, req, replyNonce)
+	}
+
+	body, notes, err := s.handleMessage(req, msg, replyNonce)
+	for _, n := range notes {
+		notify(n.conns, n.action)
+	}
+	if err != nil {
+		return errorReply(req.Action, err)
+	}
+
+	return map[string]interface{}{
+		"action":  req.Action,
+		"message": box.Seal(nil, body, replyNonce, c.clientPubkey, c.privkey),
+		"nonce":   replyNonce[:],
+	}
+}
+
+func (s *Server) changePublicKeys(c *conn, b []byte) (interface{}, error) {
+	var req kpclient.ChangePublicKeysRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, fail(kpclient.CodeEmptyMessageReceived)
+	}
+
+	s.mu.Lock()
+	err := s.injectedError(req.Action)
+	version := s.Version
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.PulicKey) != 32 {
+		return nil, fail(kpclient.CodeClientPublicKeyNotReceived)
+	}
+	if len(req.Nonce) != 24 {
+		return nil, fail(kpclient.CodeCannotDecryptMessage)
+	}
+
+	pubkey, privkey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fail(kpclient.CodeKeyChangeFailed)
+	}
+	c.pubkey, c.privkey = pubkey, privkey
+	c.clientPubkey = (*[32]byte)(req.PulicKey)
+
+	return map[string]interface{}{
+		"action":    req.Action,
+		"version":   version,
+		"publicKey": pubkey[:],
+		"nonce":     incrementNonce((*[24]byte)(req.Nonce))[:],
+		"success":   "true",
+	}, nil
+}
+
+// note is a notification to send to clients.
+type note struct {
+	conns  []*conn
+	action string
+}
+
+// handleMessage returns the encoded reply to a decrypted request message.
+// It also returns the notifications to send if the request locked or
+// unlocked the database.
+func (s *Server) handleMessage(
+	req kpclient.Request, msg []byte, nonce *[24]byte,
+) (body []byte, notes []note, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = s.injectedError(req.Action); err != nil {
+		return
+	}
+
+	if s.locked && req.TriggerUnlock && s.UnlockOnTrigger {
+		notes = append(notes, note{s.setLocked(false), kpclient.ActionDatabaseUnlocked})
+	}
+
+	reply, err := s.dispatch(req.Action, msg)
+	if err != nil {
+		return
+	}
+
+	if req.Action == kpclient.ActionLockDatabase {
+		notes = append(notes, note{s.setLocked(true), kpclient.ActionDatabaseLocked})
+	}
+
+	reply["version"] = s.Version
+	reply["nonce"] = nonce[:]
+	if _, ok := reply["success"]; !ok {
+		reply["success"] = "true"
+	}
+
+	// The reply is encoded while s.mu is held, since it may refer to
+	// the database.
+	body, err = json.Marshal(reply)
+
+	return
+}
+
+// dispatch performs an action. s.mu must be held.
+func (s *Server) dispatch(action string, msg []byte) (map[string]interface{}, error) {
+	if s.locked && action != kpclient.ActionRequestAutotype {
+		// Like processClientMessage in src/browser/BrowserAction.cpp,
+		// every action except change-public-keys (handled before this)
+		// and request-autotype fails while no database is unlocked,
+		// including lock-database and generate-password.
+		return nil, fail(kpclient.CodeDatabaseNotOpened)
+	}
+
+	switch action {
+	case kpclient.ActionGeneratePassword:
+		return map[string]interface{}{"password": s.GeneratedPassword}, nil
+
+	case kpclient.ActionGetDatabaseHash:
+		return map[string]interface{}{"hash": s.db.Hash}, nil
+
+	case kpclient.ActionLockDatabase:
+		// The database is locked by handleMessage, which notifies clients.
+		return map[string]interface{}{}, nil
+
+	case kpclient.ActionAssociate:
+		var r kpclient.AssociateRequest
+		if err := json.Unmarshal(msg, &r); err != nil || len(r.IDKey) == 0 {
+			return nil, fail(kpclient.CodeAssociationFailed)
+		}
+		if s.DenyAssociation {
+			return nil, fail(kpclient.CodeActionCancelledOrDenied)
+		}
+
+		id := fmt.Sprintf("kpxctest %d", len(s.associations)+1)
+		s.associations[id] = r.IDKey
+		return map[string]interface{}{"id": id, "hash": s.db.Hash}, nil
+
+	case kpclient.ActionTestAssociate:
+		var r kpclient.TestAssociateRequest
+		if err := json.Unmarshal(msg, &r); err != nil || !s.associated(r.DBKey) {
+			return nil, fail(kpclient.CodeAssociationFailed)
+		}
+		return map[string]interface{}{"id": r.ID, "hash": s.db.Hash}, nil
+
+	case kpclient.ActionGetLogins:
+		return s.getLogins(msg)
+
+	case kpclient.ActionGetTOTP:
+		var r kpclient.GetTOTPRequest
+		if err := json.Unmarshal(msg, &r); err != nil {
+			return nil, fail(kpclient.CodeNoValidUUIDProvided)
+		}
+
+		// Like KeePassXC, an entry without TOTP gets an empty code.
+		totp := ""
+		if e := s.entry(r.UUID); e != nil {
+			totp = e.TOTP
+		}
+		return map[string]interface{}{"totp": totp}, nil
+
+	case kpclient.ActionSetLogin:
+		return s.setLogin(msg)
+
+	case kpclient.ActionGetDatabaseGroups:
+		if len(s.db.Groups) == 0 {
+			return nil, fail(kpclient.CodeNoGroupsFound)
+		}
+		return map[string]interface{}{
+			"defaultGroup":            "",
+			"defaultGroupAlwaysAllow": false,
+			"groups":                  map[string]interface{}{"groups": s.db.Groups},
+		}, nil
+
+	case kpclient.ActionCreateNewGroup:
+		var r kpclient.CreateNewGroupRequest
+		if err := json.Unmarshal(msg, &r); err != nil || r.GroupName == "" {
+			return nil, fail(kpclient.CodeCannotCreateNewGroup)
+		}
+
+		g := createGroup(&s.db.Groups, r.GroupName)
+		return map[string]interface{}{"name": g.Name, "uuid": g.UUID}, nil
+
+	case kpclient.ActionDeleteEntry:
+		var r kpclient.DeleteEntryRequest
+		if err := json.Unmarshal(msg, &r); err != nil || r.UUID == "" {
+			return nil, fail(kpclient.CodeNoValidUUIDProvided)
+		}
+
+		for i := range s.db.Entries {
+			if s.db.Entries[i].UUID == r.UUID {
+				s.db.Entries = append(s.db.Entries[:i], s.db.Entries[i+1:]...)
+				return map[string]interface{}{}, nil
+			}
+		}
+		return map[string]interface{}{"success": "false"}, nil
+
+	case kpclient.ActionRequestAutotype:
+		var r kpclient.RequestAutotypeRequest
+		if err := json.Unmarshal(msg, &r); err != nil || r.Search == "" {
+			return nil, fail(kpclient.CodeNoURLProvided)
+		}
+
+		s.autotype = append(s.autotype, r.Search)
+		return map[string]interface{}{}, nil
+
+	default:
+		return nil, fail(kpclient.CodeIncorrectAction)
+	}
+}
+
+// associated reports whether a client identity is associated with the
+// database. s.mu must be held.
+func (s *Server) associated(k kpclient.DBKey) bool {
+	key, ok := s.associations[k.ID]
+	return ok && string(key) == string(k.Key)
+}
+
+// entry returns the entry with the given UUID. s.mu must be held.
+func (s *Server) entry(uuid string) *Entry {
+	for i := range s.db.Entries {
+		if s.db.Entries[i].UUID == uuid {
+			return &s.db.Entries[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) getLogins(msg []byte) (map[string]interface{}, error) {
+	var r kpclient.GetLoginsRequest
+	if err := json.Unmarshal(msg, &r); err != nil || r.URL == "" {
+		return nil, fail(kpclient.CodeNoURLProvided)
+	}
+
+	// Entries are only returned to clients associated with the database.
+	associated := false
+	for _, k := range r.Keys {
+		associated = associated || s.associated(k)
+	}
+	if !associated {
+		return nil, fail(kpclient.CodeNoLoginsFound)
+	}
+
+	var entries []kpclient.LoginEntry
+	for _, e := range s.db.Entries {
+		if !matchURL(e.URL, r.URL) {
+			continue
+		}
+
+		le := kpclient.LoginEntry{Login: e.Login, Name: e.Name, Password: e.Password, UUID: e.UUID}
+		for k, v := range e.StringFields {
+			le.StringFields = append(le.StringFields, map[string]string{k: v})
+		}
+		entries = append(entries, le)
+	}
+	if len(entries) == 0 {
+		return nil, fail(kpclient.CodeNoLoginsFound)
+	}
+
+	return map[string]interface{}{
+		"count":   len(entries),
+		"entries": entries,
+		"hash":    s.db.Hash,
+	}, nil
+}
+
+func (s *Server) setLogin(msg []byte) (map[string]interface{}, error) {
+	var r kpclient.SetLoginRequest
+	if err := json.Unmarshal(msg, &r); err != nil || r.URL == "" {
+		return nil, fail(kpclient.CodeNoURLProvided)
+	}
+
+	e := s.entry(r.UUID)
+	if e == nil {
+		s.db.Entries = append(s.db.Entries, Entry{UUID: newUUID(), Name: host(r.URL)})
+		e = &s.db.Entries[len(s.db.Entries)-1]
+	}
+	e.Login, e.Password, e.URL = r.Login, r.Password, r.URL
+
+	switch {
+	case r.GroupUUID != "":
+		if g := findGroup(s.db.Groups, r.GroupUUID); g != nil {
+			e.Group = g.UUID
+		}
+	case r.Group != "":
+		if g := findGroup(s.db.Groups, r.Group); g != nil {
+			e.Group = g.UUID
+		}
+	}
+
+	return map[string]interface{}{}, nil
+}
+
+func incrementNonce(b *[24]byte) *[24]byte {
+	out := &[24]byte{}
+
+	c := 1
+	for i := range b {
+		c += int(b[i])
+		out[i] = byte(c)
+		c >>= 8
+	}
+
+	return out
+}
@@ -0,0 +1,338 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpxctest_test
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/nwwdles/kpxcpc/kpclient"
+	"gitlab.com/nwwdles/kpxcpc/kpclient/kpxctest"
+	"gotest.tools/assert"
+)
+
+func newServer(t *testing.T) *kpxctest.Server {
+	t.Helper()
+
+	f, err := kpxctest.LoadFixture(filepath.Join("testdata", "fixture.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := kpxctest.NewServer(f)
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+// newClient returns a client that exchanged keys with the server and is
+// associated with its database.
+func newClient(t *testing.T, s *kpxctest.Server) *kpclient.Client {
+	t.Helper()
+
+	c, err := kpclient.New(s.Connect(), nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	if _, err := c.ChangePublicKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Associate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestServer_association(t *testing.T) {
+	s := newServer(t)
+	c := newClient(t, s)
+
+	_, err := c.TestAssociate(false)
+	assert.NilError(t, err)
+
+	idKey, id := c.AssociationData()
+	assert.DeepEqual(t, s.Associations(), []kpclient.DBKey{{ID: id, Key: idKey[:]}})
+
+	hash, err := c.GetDatabaseHash(false)
+	assert.NilError(t, err)
+	assert.Equal(t, hash, s.Hash())
+
+	// A client with an unknown identity is rejected.
+	c.SetAssociation([]byte("unknown"), id)
+	_, err = c.TestAssociate(false)
+	assert.Assert(t, errors.Is(err, kpclient.ErrAssociationFailed), err)
+}
+
+func TestServer_denyAssociation(t *testing.T) {
+	s := newServer(t)
+	s.DenyAssociation = true
+
+	c, err := kpclient.New(s.Connect(), nil, nil, "")
+	assert.NilError(t, err)
+	defer c.Close()
+
+	_, err = c.ChangePublicKeys()
+	assert.NilError(t, err)
+
+	_, err = c.Associate()
+	assert.Assert(t, errors.Is(err, kpclient.ErrActionCancelledOrDenied), err)
+}
+
+func TestServer_keyExchangeRequired(t *testing.T) {
+	s := newServer(t)
+
+	c, err := kpclient.New(s.Connect(), nil, nil, "")
+	assert.NilError(t, err)
+	defer c.Close()
+
+	_, err = c.GeneratePassword()
+	assert.Assert(t, errors.Is(err, kpclient.ErrClientPublicKeyNotReceived), err)
+}
+
+func TestServer_GetLogins(t *testing.T) {
+	s := newServer(t)
+	c := newClient(t, s)
+
+	resp, err := c.GetLogins("https://example.com/", kpclient.GetLoginsOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Count, 2)
+	assert.Equal(t, resp.Entries[0].Login, "elon")
+	assert.DeepEqual(t, resp.Entries[0].StringFields, []map[string]string{{"KPH: myfield": "hello world"}})
+	assert.Equal(t, resp.Entries[1].Login, "admin")
+
+	_, err = c.GetLogins("https://nothing.example.com", kpclient.GetLoginsOptions{})
+	assert.Assert(t, errors.Is(err, kpclient.ErrNoLoginsFound), err)
+
+	// Entries aren't returned to clients that aren't associated.
+	other := newClient(t, s)
+	other.SetAssociation([]byte("unknown"), "unknown")
+	_, err = other.GetLogins("https://example.com", kpclient.GetLoginsOptions{})
+	assert.Assert(t, errors.Is(err, kpclient.ErrNoLoginsFound), err)
+}
+
+func TestServer_GetTOTP(t *testing.T) {
+	s := newServer(t)
+	c := newClient(t, s)
+
+	resp, err := c.GetTOTP("d1e6cba53ad04e8fb23f2991c160ce5a")
+	assert.NilError(t, err)
+	assert.Equal(t, resp.TOTP, "123456")
+
+	resp, err = c.GetTOTP("5b3c1a2d4e6f4a8b9c0d1e2f3a4b5c6d")
+	assert.NilError(t, err)
+	assert.Equal(t, resp.TOTP, "")
+}
+
+func TestServer_entries(t *testing.T) {
+	s := newServer(t)
+	c := newClient(t, s)
+
+	_, err := c.SetLogin(kpclient.LoginOptions{
+		URL:      "https://new.example.net",
+		Login:    "carol",
+		Password: "secret",
+		Group:    "Infra",
+	})
+	assert.NilError(t, err)
+
+	resp, err := c.GetLogins("https://new.example.net", kpclient.GetLoginsOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Count, 1)
+	assert.Equal(t, resp.Entries[0].Password, "secret")
+
+	entries := s.Entries()
+	assert.Equal(t, entries[len(entries)-1].Group, "8d4e1f0a3b2c4d5e9f8a7b6c5d4e3f2a")
+
+	// Update it.
+	_, err = c.SetLogin(kpclient.LoginOptions{
+		URL:      "https://new.example.net",
+		Login:    "carol",
+		Password: "changed",
+		UUID:     resp.Entries[0].UUID,
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, len(s.Entries()), len(entries))
+
+	_, err = c.DeleteEntry(resp.Entries[0].UUID)
+	assert.NilError(t, err)
+	_, err = c.GetLogins("https://new.example.net", kpclient.GetLoginsOptions{})
+	assert.Assert(t, errors.Is(err, kpclient.ErrNoLoginsFound), err)
+
+	// The entry is gone now.
+	_, err = c.DeleteEntry(resp.Entries[0].UUID)
+	assert.Assert(t, errors.Is(err, kpclient.ErrEntryNotDeleted), err)
+	_, err = c.DeleteEntry("00000000000000000000000000000000")
+	assert.Assert(t, errors.Is(err, kpclient.ErrEntryNotDeleted), err)
+}
+
+func TestServer_groups(t *testing.T) {
+	s := newServer(t)
+	c := newClient(t, s)
+
+	resp, err := c.CreateNewGroup("Work/Infra/Servers")
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Name, "Servers")
+
+	groups, err := c.GetDatabaseGroups()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, groups.Groups.Groups, s.Groups())
+
+	infra := groups.Groups.Groups[0].Children[0].Children[0]
+	assert.Equal(t, infra.UUID, "8d4e1f0a3b2c4d5e9f8a7b6c5d4e3f2a")
+	assert.Equal(t, len(infra.Children), 1)
+	assert.Equal(t, infra.Children[0].UUID, resp.UUID)
+
+	// Existing groups are returned as they are.
+	again, err := c.CreateNewGroup("Work/Infra/Servers")
+	assert.NilError(t, err)
+	assert.Equal(t, again.UUID, resp.UUID)
+}
+
+func TestServer_lock(t *testing.T) {
+	s := newServer(t)
+	c := newClient(t, s)
+
+	_, err := c.LockDatabase()
+	assert.NilError(t, err)
+	assert.Assert(t, s.Locked())
+	assertEvent(t, c, kpclient.ActionDatabaseLocked)
+
+	_, err = c.GetLogins("https://example.com", kpclient.GetLoginsOptions{})
+	assert.Assert(t, errors.Is(err, kpclient.ErrDatabaseNotOpened), err)
+	_, err = c.GetDatabaseHash(true)
+	assert.Assert(t, errors.Is(err, kpclient.ErrDatabaseNotOpened), err)
+
+	_, err = c.GeneratePassword()
+	assert.Assert(t, errors.Is(err, kpclient.ErrDatabaseNotOpened), err)
+
+	// Locking it again succeeds, although KeePassXC replies that the
+	// database isn't opened.
+	_, err = c.LockDatabase()
+	assert.NilError(t, err)
+
+	// Auto-type can be requested with a locked database.
+	_, err = c.RequestAutotype("https://example.com")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, s.AutotypeRequests(), []string{"https://example.com"})
+
+	s.Unlock()
+	assertEvent(t, c, kpclient.ActionDatabaseUnlocked)
+
+	_, err = c.GetLogins("https://example.com", kpclient.GetLoginsOptions{})
+	assert.NilError(t, err)
+}
+
+func TestServer_unlockOnTrigger(t *testing.T) {
+	s := newServer(t)
+	s.UnlockOnTrigger = true
+	c := newClient(t, s)
+	s.Lock()
+	assertEvent(t, c, kpclient.ActionDatabaseLocked)
+
+	_, err := c.GetDatabaseHash(false)
+	assert.Assert(t, errors.Is(err, kpclient.ErrDatabaseNotOpened), err)
+
+	_, err = c.GetDatabaseHash(true)
+	assert.NilError(t, err)
+	assertEvent(t, c, kpclient.ActionDatabaseUnlocked)
+}
+
+func assertEvent(t *testing.T, c *kpclient.Client, action string) {
+	t.Helper()
+
+	select {
+	case e := <-c.Events():
+		assert.Equal(t, e.Action, action)
+	case <-time.After(time.Second):
+		t.Fatalf("no %s event", action)
+	}
+}
+
+func TestServer_InjectError(t *testing.T) {
+	s := newServer(t)
+	c := newClient(t, s)
+	s.InjectError(kpclient.ActionGetLogins, kpclient.CodeCannotDecryptMessage)
+	s.InjectError(kpclient.ActionGetLogins, kpclient.CodeTimeoutOrNotConnected)
+
+	_, err := c.GetLogins("https://example.com", kpclient.GetLoginsOptions{})
+	assert.Assert(t, errors.Is(err, kpclient.ErrCannotDecryptMessage), err)
+	_, err = c.GetLogins("https://example.com", kpclient.GetLoginsOptions{})
+	assert.Assert(t, errors.Is(err, kpclient.ErrTimeoutOrNotConnected), err)
+	_, err = c.GetLogins("https://example.com", kpclient.GetLoginsOptions{})
+	assert.NilError(t, err)
+}
+
+func TestServer_RequestAutotype(t *testing.T) {
+	s := newServer(t)
+	c := newClient(t, s)
+
+	_, err := c.RequestAutotype("https://example.com")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, s.AutotypeRequests(), []string{"https://example.com"})
+}
+
+func TestServer_Version(t *testing.T) {
+	s := newServer(t)
+	s.Version = "2.6.6"
+	c := newClient(t, s)
+
+	assert.Equal(t, c.ServerVersion(), "2.6.6")
+	assert.Assert(t, !c.Supports(kpclient.ActionRequestAutotype))
+
+	_, err := c.RequestAutotype("https://example.com")
+	assert.Assert(t, errors.Is(err, kpclient.ErrUnsupportedAction), err)
+	assert.Equal(t, len(s.AutotypeRequests()), 0)
+}
+
+func TestServer_Serve(t *testing.T) {
+	s := newServer(t)
+
+	path := filepath.Join(t.TempDir(), "kpxc_server")
+	l, err := net.Listen("unix", path)
+	assert.NilError(t, err)
+
+	done := make(chan error)
+	go func() { done <- s.Serve(l) }()
+
+	tr, err := kpclient.DialSocket(path)
+	assert.NilError(t, err)
+	c, err := kpclient.New(tr, nil, nil, "")
+	assert.NilError(t, err)
+	defer c.Close()
+
+	_, err = c.ChangePublicKeys()
+	assert.NilError(t, err)
+	hash, err := c.GetDatabaseHash(false)
+	assert.NilError(t, err)
+	assert.Equal(t, hash, s.Hash())
+
+	assert.NilError(t, s.Close())
+	assert.NilError(t, <-done)
+}
@@ -24,11 +24,25 @@
 package kpclient
 
 const (
-	ActionChangePublicKeys = "change-public-keys"
-	ActionAssociate        = "associate"
-	ActionGetLogins        = "get-logins"
-	ActionTestAssociate    = "test-associate"
-	ActionGetTOTP          = "get-totp"
+	ActionChangePublicKeys  = "change-public-keys"
+	ActionAssociate         = "associate"
+	ActionGetLogins         = "get-logins"
+	ActionTestAssociate     = "test-associate"
+	ActionGetTOTP           = "get-totp"
+	ActionGeneratePassword  = "generate-password"
+	ActionSetLogin          = "set-login"
+	ActionGetDatabaseHash   = "get-databasehash"
+	ActionLockDatabase      = "lock-database"
+	ActionGetDatabaseGroups = "get-database-groups"
+	ActionCreateNewGroup    = "create-new-group"
+	ActionDeleteEntry       = "delete-entry"
+	ActionRequestAutotype   = "request-autotype"
+	ActionPasskeysGet       = "passkeys-get"
+	ActionPasskeysRegister  = "passkeys-register"
+
+	// Notifications sent by KeePassXC on its own.
+	ActionDatabaseLocked   = "database-locked"
+	ActionDatabaseUnlocked = "database-unlocked"
 )
 
 type Request struct {
@@ -104,6 +118,10 @@ type LoginEntry struct {
 	Password     string              `json:"password"`
 	UUID         string              `json:"uuid"`
 	StringFields []map[string]string `json:"stringFields"`
+
+	// Database is the ID of the association the entry was found with.
+	// It is set by the client and not sent by KeePassXC.
+	Database string `json:"database,omitempty"`
 }
 
 type GetTOTPRequest struct {
@@ -115,3 +133,120 @@ type GetTOTPResponse struct {
 	Response
 	TOTP string `json:"totp"`
 }
+
+type GeneratePasswordRequest struct {
+	Action string `json:"action"`
+}
+
+type GeneratePasswordResponse struct {
+	Response
+	Password string `json:"password"`
+	// Entries holds the password in KeePassXC versions before 2.7.0.
+	Entries []LoginEntry `json:"entries"`
+}
+
+type SetLoginRequest struct {
+	Action    string `json:"action"`
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	SubmitURL string `json:"submitUrl"`
+	Login     string `json:"login"`
+	Password  string `json:"password"`
+	Group     string `json:"group,omitempty"`
+	GroupUUID string `json:"groupUuid,omitempty"`
+	UUID      string `json:"uuid,omitempty"` // existing entry to update
+}
+
+type SetLoginResponse struct {
+	Response
+}
+
+type GetDatabaseHashRequest struct {
+	Action string `json:"action"`
+}
+
+type GetDatabaseHashResponse struct {
+	Response
+}
+
+type LockDatabaseRequest struct {
+	Action string `json:"action"`
+}
+
+type LockDatabaseResponse struct {
+	Response
+}
+
+type GetDatabaseGroupsRequest struct {
+	Action string `json:"action"`
+}
+
+type GetDatabaseGroupsResponse struct {
+	Response
+	DefaultGroup            string         `json:"defaultGroup"`
+	DefaultGroupAlwaysAllow bool           `json:"defaultGroupAlwaysAllow"`
+	Groups                  DatabaseGroups `json:"groups"`
+}
+
+type DatabaseGroups struct {
+	Groups []Group `json:"groups"`
+}
+
+type Group struct {
+	Name     string  `json:"name"`
+	UUID     string  `json:"uuid"`
+	Children []Group `json:"children"`
+}
+
+type CreateNewGroupRequest struct {
+	Action    string `json:"action"`
+	GroupName string `json:"groupName"`
+}
+
+type CreateNewGroupResponse struct {
+	Response
+	Name string `json:"name"`
+	UUID string `json:"uuid"`
+}
+
+type DeleteEntryRequest struct {
+	Action string `json:"action"`
+	UUID   string `json:"uuid"`
+}
+
+type DeleteEntryResponse struct {
+	Response
+}
+
+type RequestAutotypeRequest struct {
+	Action string `json:"action"`
+	Search string `json:"search"`
+}
+
+type RequestAutotypeResponse struct {
+	Response
+}
+
+type PasskeysGetRequest struct {
+	Action    string                            `json:"action"`
+	PublicKey PublicKeyCredentialRequestOptions `json:"publicKey"`
+	Origin    string                            `json:"origin"`
+	Keys      []DBKey                           `json:"keys"`
+}
+
+type PasskeysGetResponse struct {
+	Response
+	Credential PublicKeyCredentialAssertion `json:"response"`
+}
+
+type PasskeysRegisterRequest struct {
+	Action    string                             `json:"action"`
+	PublicKey PublicKeyCredentialCreationOptions `json:"publicKey"`
+	Origin    string                             `json:"origin"`
+	Keys      []DBKey                            `json:"keys"`
+}
+
+type PasskeysRegisterResponse struct {
+	Response
+	Credential PublicKeyCredentialAttestation `json:"response"`
+}
@@ -0,0 +1,84 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// messageTypes returns new values of the messages exchanged with KeePassXC.
+func messageTypes() []interface{} {
+	return []interface{}{
+		&Request{},
+		&Response{},
+		&ChangePublicKeysRequest{},
+		&ChangePublicKeysResponse{},
+		&GetLoginsRequest{},
+		&GetLoginsResponse{},
+		&GetTOTPResponse{},
+		&GeneratePasswordResponse{},
+		&SetLoginRequest{},
+		&GetDatabaseGroupsResponse{},
+		&CreateNewGroupResponse{},
+		&PasskeysGetResponse{},
+		&PasskeysRegisterResponse{},
+	}
+}
+
+// FuzzMessages checks that messages decoded from JSON are encoded back to
+// JSON that decodes to the same message. The encodings are compared rather
+// than the messages, since omitempty turns empty slices into nil ones.
+func FuzzMessages(f *testing.F) {
+	for _, e := range sessionSeeds(f) {
+		for _, m := range []json.RawMessage{e.Request, e.Reply, e.Error} {
+			if m != nil {
+				f.Add([]byte(m))
+			}
+		}
+	}
+	f.Add([]byte(`{"action":"get-logins","triggerUnlock":"true","nonce":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}`))
+	f.Add([]byte(`{"errorCode":"15","success":"false","error":"No logins found"}`))
+	f.Add([]byte(`{"errorCode":15,"success":false}`))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for i, v := range messageTypes() {
+			if err := json.Unmarshal(b, v); err != nil {
+				continue
+			}
+
+			enc, err := json.Marshal(v)
+			assert.NilError(t, err)
+
+			got := messageTypes()[i]
+			assert.NilError(t, json.Unmarshal(enc, got), "%s", enc)
+
+			again, err := json.Marshal(got)
+			assert.NilError(t, err)
+			assert.Equal(t, string(again), string(enc))
+		}
+	})
+}
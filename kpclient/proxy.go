@@ -0,0 +1,146 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// maxProxyMessageSize limits the size of a message read from the proxy,
+// so that a corrupted length prefix doesn't make us allocate gigabytes.
+const maxProxyMessageSize = 16 << 20
+
+var ErrMessageTooLarge = errors.New("message too large")
+
+// ProxyTransport talks to KeePassXC through a keepassxc-proxy process using
+// the browser native messaging framing: each message is JSON prefixed with
+// its length as a 32-bit little-endian integer.
+//
+// It is useful when the KeePassXC socket can't be reached directly, e.g. in
+// a Flatpak sandbox or in a container with only the proxy available.
+type ProxyTransport struct {
+	cmd *exec.Cmd
+	r   *os.File // proxy's stdout
+	w   *os.File // proxy's stdin
+}
+
+// DialProxy starts the keepassxc-proxy executable at path and connects to
+// its stdin and stdout.
+func DialProxy(path string, args ...string) (*ProxyTransport, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Start()
+
+	// The child has its own copies now.
+	stdinR.Close()
+	stdoutW.Close()
+
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		return nil, fmt.Errorf("failed to start proxy: %w", err)
+	}
+
+	return &ProxyTransport{cmd: cmd, r: stdoutR, w: stdinW}, nil
+}
+
+func (p *ProxyTransport) Send(msg []byte) error {
+	msg = bytes.TrimRight(msg, "\n")
+	if len(msg) > maxProxyMessageSize {
+		return fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, len(msg))
+	}
+
+	frame := make([]byte, 4+len(msg))
+	binary.LittleEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[4:], msg)
+
+	_, err := p.w.Write(frame)
+
+	return err
+}
+
+func (p *ProxyTransport) Receive() ([]byte, error) {
+	var size uint32
+	if err := binary.Read(p.r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxProxyMessageSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, size)
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(p.r, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (p *ProxyTransport) SetWriteDeadline(d time.Time) error {
+	return p.w.SetWriteDeadline(d)
+}
+
+// Close closes the proxy's stdin and waits for it to exit.
+func (p *ProxyTransport) Close() error {
+	werr := p.w.Close()
+	rerr := p.r.Close()
+
+	if p.cmd == nil {
+		return errors.Join(werr, rerr)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- p.cmd.Wait() }()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		_ = p.cmd.Process.Kill()
+		<-done
+	}
+
+	return errors.Join(werr, rerr)
+}
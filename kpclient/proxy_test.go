@@ -0,0 +1,123 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// TestProxyHelper isn't a real test: it's run as a fake keepassxc-proxy
+// process that echoes requests back as replies, with the nonce incremented.
+func TestProxyHelper(t *testing.T) {
+	if os.Getenv("KPXCPC_PROXY_HELPER") != "1" {
+		t.Skip("helper process")
+	}
+
+	for {
+		var size uint32
+		if err := binary.Read(os.Stdin, binary.LittleEndian, &size); err != nil {
+			os.Exit(0)
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(os.Stdin, msg); err != nil {
+			os.Exit(1)
+		}
+
+		var m map[string]interface{}
+		if err := json.Unmarshal(msg, &m); err != nil {
+			os.Exit(1)
+		}
+		var nonce [24]byte
+		n, _ := base64.StdEncoding.DecodeString(m["nonce"].(string))
+		copy(nonce[:], n)
+		m["nonce"] = incrementNonce(&nonce)[:]
+		msg, _ = json.Marshal(m)
+		size = uint32(len(msg))
+
+		if err := binary.Write(os.Stdout, binary.LittleEndian, size); err != nil {
+			os.Exit(1)
+		}
+		if _, err := os.Stdout.Write(msg); err != nil {
+			os.Exit(1)
+		}
+	}
+}
+
+func TestDialProxy(t *testing.T) {
+	t.Setenv("KPXCPC_PROXY_HELPER", "1")
+
+	p, err := DialProxy(os.Args[0], "-test.run=^TestProxyHelper$")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := New(p, nil, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The echoed request looks enough like a reply.
+	for i := 0; i < 2; i++ {
+		resp, err := c.ChangePublicKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.DeepEqual(t, resp.PulicKey, c.pubkey[:])
+	}
+}
+
+func TestProxyTransport(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &ProxyTransport{r: r, w: w}
+	defer p.Close()
+
+	if err := p.Send([]byte("{\"a\":1}\n")); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := p.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(msg), `{"a":1}`)
+
+	if err := binary.Write(w, binary.LittleEndian, uint32(maxProxyMessageSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Receive(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("got err %v, want %v", err, ErrMessageTooLarge)
+	}
+}
@@ -0,0 +1,216 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Redacted replaces secrets in messages redacted by Redact. It is valid
+// base64, so redacted keys can still be decoded.
+const Redacted = "REDACTED"
+
+// redactedFields are the message fields holding secrets.
+var redactedFields = map[string]bool{
+	"password":  true,
+	"idKey":     true,
+	"key":       true,
+	"publicKey": true,
+	"totp":      true,
+}
+
+// Exchange is a request sent to KeePassXC and its reply, as passed to an
+// Observer.
+type Exchange struct {
+	Action string `json:"action"`
+
+	// Request is the decrypted request message. For change-public-keys,
+	// which isn't encrypted, it is the request itself.
+	Request json.RawMessage `json:"request"`
+
+	// Reply is the decrypted reply message, or the reply itself for
+	// change-public-keys. It is empty if KeePassXC replied with an error.
+	Reply json.RawMessage `json:"reply,omitempty"`
+
+	// Error is the reply if KeePassXC replied with an error. Error replies
+	// aren't encrypted.
+	Error json.RawMessage `json:"error,omitempty"`
+
+	// Err is the error the request failed with, if any.
+	Err error `json:"-"`
+
+	// Sent and Received are the request and the reply as they were sent
+	// and received, with the message encrypted. Received is empty if no
+	// reply arrived.
+	Sent     json.RawMessage `json:"-"`
+	Received json.RawMessage `json:"-"`
+
+	// Start is when the request was made, and Duration how long it took
+	// to get the reply or to fail.
+	Start    time.Time     `json:"-"`
+	Duration time.Duration `json:"-"`
+}
+
+// Observers is an Observer notifying each of several observers in turn.
+type Observers []Observer
+
+func (obs Observers) Observe(e Exchange) {
+	for _, o := range obs {
+		o.Observe(e)
+	}
+}
+
+// Observer is notified of the exchanges of a client with KeePassXC, e.g. to
+// record them. Observe may be called from several goroutines at once.
+type Observer interface {
+	Observe(e Exchange)
+}
+
+// Session is a recorded sequence of exchanges.
+type Session struct {
+	Exchanges []Exchange `json:"exchanges"`
+}
+
+// Recorder is a Transport that records the exchanges of the client using
+// it, with secrets redacted. It is an Observer, so it is used by the client
+// automatically:
+//
+//	r := kpclient.NewRecorder(t)
+//	c, err := kpclient.New(r, nil, nil, "")
+//	...
+//	err = r.WriteSession(f)
+type Recorder struct {
+	Transport
+
+	mu        sync.Mutex
+	exchanges []Exchange
+}
+
+func NewRecorder(t Transport) *Recorder {
+	return &Recorder{Transport: t}
+}
+
+// Observe records an exchange. Exchanges that failed without a reply from
+// KeePassXC, e.g. because the reply couldn't be decrypted, are skipped.
+func (r *Recorder) Observe(e Exchange) {
+	if e.Reply == nil && e.Error == nil {
+		return
+	}
+
+	// Only the decrypted messages are recorded.
+	e.Sent, e.Received = nil, nil
+
+	e.Request = Redact(e.Request)
+	if e.Reply != nil {
+		e.Reply = Redact(e.Reply)
+	}
+	e.Err = nil
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.exchanges = append(r.exchanges, e)
+}
+
+// Session returns the exchanges recorded so far.
+func (r *Recorder) Session() Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return Session{Exchanges: append([]Exchange{}, r.exchanges...)}
+}
+
+// WriteSession writes the recorded session as indented JSON.
+func (r *Recorder) WriteSession(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(r.Session())
+}
+
+// Redact returns a JSON message with the values of fields holding secrets,
+// such as passwords, keys and TOTP codes, and of custom entry fields
+// replaced by Redacted. A message that isn't valid JSON is redacted
+// entirely.
+func Redact(msg []byte) []byte {
+	var v interface{}
+	if err := json.Unmarshal(msg, &v); err != nil {
+		b, _ := json.Marshal(Redacted)
+		return b
+	}
+
+	b, err := json.Marshal(redact(v))
+	if err != nil {
+		b, _ = json.Marshal(Redacted)
+	}
+
+	return b
+}
+
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, f := range v {
+			switch {
+			case k == "stringFields":
+				v[k] = redactAll(f)
+			case redactedFields[k]:
+				if _, ok := f.(string); ok {
+					v[k] = Redacted
+				} else {
+					v[k] = redact(f)
+				}
+			default:
+				v[k] = redact(f)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+	}
+
+	return v
+}
+
+// redactAll replaces all strings in v.
+func redactAll(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return Redacted
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = redactAll(v[k])
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactAll(v[i])
+		}
+	}
+
+	return v
+}
@@ -0,0 +1,122 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{
+			name: "entries",
+			msg: `{"entries":[{"login":"elon","password":"hunter2","stringFields":[{"KPH: otp":"secret"}]}],` +
+				`"hash":"29234e"}`,
+			want: `{"entries":[{"login":"elon","password":"REDACTED","stringFields":[{"KPH: otp":"REDACTED"}]}],` +
+				`"hash":"29234e"}`,
+		},
+		{
+			name: "keys",
+			msg:  `{"action":"associate","idKey":"aWRrZXk=","key":"a2V5","keys":[{"id":"a","key":"a2V5"}]}`,
+			want: `{"action":"associate","idKey":"REDACTED","key":"REDACTED","keys":[{"id":"a","key":"REDACTED"}]}`,
+		},
+		{
+			name: "totp",
+			msg:  `{"totp":"123456","success":"true"}`,
+			want: `{"success":"true","totp":"REDACTED"}`,
+		},
+		{
+			name: "passkey options",
+			msg:  `{"publicKey":{"challenge":"Y2hhbGxlbmdl","rpId":"example.com"}}`,
+			want: `{"publicKey":{"challenge":"Y2hhbGxlbmdl","rpId":"example.com"}}`,
+		},
+		{
+			name: "invalid",
+			msg:  `{"password":"hunter2"`,
+			want: `"REDACTED"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, string(Redact([]byte(tt.msg))), tt.want)
+		})
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	c := newMockClientFunc(t, func(req Request, msg []byte) interface{} {
+		if req.Action == ActionGetTOTP {
+			msg, code := "No logins found", CodeNoLoginsFound
+			return Response{Error: &msg, Code: &code}
+		}
+		return `{"password":"hunter2","success":"true"}`
+	})
+	r := NewRecorder(nil)
+	c.SetObserver(r)
+
+	_, err := c.GeneratePassword()
+	assert.NilError(t, err)
+	_, err = c.GetTOTP("uuid")
+	assert.ErrorContains(t, err, "No logins found")
+
+	var b bytes.Buffer
+	assert.NilError(t, r.WriteSession(&b))
+
+	var s Session
+	assert.NilError(t, json.Unmarshal(b.Bytes(), &s))
+	assert.Equal(t, len(s.Exchanges), 2)
+
+	e := s.Exchanges[0]
+	assert.Equal(t, e.Action, ActionGeneratePassword)
+	assert.Equal(t, compact(t, e.Request), `{"action":"generate-password"}`)
+	assert.Equal(t, compact(t, e.Reply), `{"password":"REDACTED","success":"true"}`)
+	assert.Assert(t, e.Error == nil)
+
+	e = s.Exchanges[1]
+	assert.Equal(t, e.Action, ActionGetTOTP)
+	assert.Assert(t, e.Reply == nil)
+
+	var resp Response
+	assert.NilError(t, json.Unmarshal(e.Error, &resp))
+	assert.Equal(t, *resp.Code, CodeNoLoginsFound)
+}
+
+func compact(t *testing.T, msg []byte) string {
+	t.Helper()
+
+	var b bytes.Buffer
+	if err := json.Compact(&b, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.String()
+}
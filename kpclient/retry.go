@@ -0,0 +1,131 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ErrRetriesExhausted is returned when a request still fails after the
+// number of attempts allowed by the RetryPolicy. It wraps the last error.
+var ErrRetriesExhausted = errors.New("retries exhausted")
+
+// RetryPolicy controls how requests that fail with a transient error are
+// retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one.
+	// Values below 1 mean a single attempt.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. It doubles after each
+	// retry up to MaxBackoff, if it is set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Retryable reports whether a request that failed with err should be
+	// retried. If nil, DefaultRetryable is used.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy is used by clients returned by New.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Backoff:     10 * time.Millisecond,
+	MaxBackoff:  time.Second,
+}
+
+// DefaultRetryable retries replies that can't be decrypted.
+//
+// TODO: find out why we can't open the response sometimes.
+// We obviously exchanged pubkeys and verified association successfully already.
+// A retry usually fixes this.
+func DefaultRetryable(err error) bool {
+	return errors.Is(err, ErrFailedToOpen)
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+
+	return p.MaxAttempts
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable == nil {
+		return DefaultRetryable(err)
+	}
+
+	return p.Retryable(err)
+}
+
+// Delay returns the delay before the given retry, starting from 1.
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && d <= math.MaxInt64/2; i++ {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+		d *= 2
+	}
+
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	return d
+}
+
+// Wait waits before retrying an operation after the given attempt,
+// counting from 1, failed with err. If that was the last attempt allowed, it
+// returns err wrapped in ErrRetriesExhausted instead. It returns ctx's error
+// if ctx is done first.
+//
+// Wait doesn't check whether err is retryable, so it can be used for
+// operations other than single requests, such as a key exchange followed by
+// a request.
+func (p RetryPolicy) Wait(ctx context.Context, attempt int, err error) error {
+	if attempt >= p.attempts() {
+		return fmt.Errorf("%w after %d attempts: %w", ErrRetriesExhausted, attempt, err)
+	}
+
+	return sleep(ctx, p.Delay(attempt))
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
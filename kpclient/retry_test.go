@@ -0,0 +1,163 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"math"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		retry  int
+		want   time.Duration
+	}{
+		{name: "first", policy: RetryPolicy{Backoff: time.Millisecond}, retry: 1, want: time.Millisecond},
+		{name: "doubles", policy: RetryPolicy{Backoff: time.Millisecond}, retry: 4, want: 8 * time.Millisecond},
+		{
+			name:   "capped",
+			policy: RetryPolicy{Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond},
+			retry:  4,
+			want:   5 * time.Millisecond,
+		},
+		{
+			name:   "capped without overflow",
+			policy: RetryPolicy{Backoff: time.Millisecond, MaxBackoff: time.Second},
+			retry:  1000,
+			want:   time.Second,
+		},
+		{name: "no backoff", policy: RetryPolicy{}, retry: 3, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.policy.Delay(tt.retry), tt.want)
+		})
+	}
+
+	d := RetryPolicy{Backoff: time.Second}.Delay(1000)
+	assert.Assert(t, d >= time.Duration(math.MaxInt64/2), d)
+}
+
+// newFlakyClient returns a client whose replies can't be opened until the
+// given number of requests has been answered.
+func newFlakyClient(t *testing.T, failures int32) (*Client, *int32) {
+	var n int32
+	c := newMockClientFunc(t, func(req Request, msg []byte) interface{} {
+		if atomic.AddInt32(&n, 1) <= failures {
+			return Response{Nonce: incrementNonce((*[24]byte)(req.Nonce))[:], Message: []byte("garbage")}
+		}
+		return `{"password": "pass"}`
+	})
+
+	return c, &n
+}
+
+func TestClient_retry(t *testing.T) {
+	c, n := newFlakyClient(t, 2)
+
+	var logs bytes.Buffer
+	c.SetLogger(log.New(&logs, "", 0))
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	resp, err := c.GeneratePassword()
+	assert.NilError(t, err)
+	assert.Equal(t, resp.Password, "pass")
+	assert.Equal(t, atomic.LoadInt32(n), int32(3))
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	assert.Equal(t, len(lines), 2)
+	assert.Assert(t, strings.HasPrefix(lines[0], "debug: generate-password failed (attempt 1 of 3)"), lines[0])
+}
+
+func TestClient_retriesExhausted(t *testing.T) {
+	c, n := newFlakyClient(t, 100)
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	_, err := c.GeneratePassword()
+	assert.Assert(t, errors.Is(err, ErrRetriesExhausted), err)
+	assert.Assert(t, errors.Is(err, ErrFailedToOpen), err)
+	assert.Equal(t, atomic.LoadInt32(n), int32(3))
+}
+
+func TestClient_notRetryable(t *testing.T) {
+	c, n := newFlakyClient(t, 100)
+	c.SetRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		Retryable:   func(err error) bool { return false },
+	})
+
+	_, err := c.GeneratePassword()
+	assert.Assert(t, errors.Is(err, ErrFailedToOpen), err)
+	assert.Assert(t, !errors.Is(err, ErrRetriesExhausted), err)
+	assert.Equal(t, atomic.LoadInt32(n), int32(1))
+}
+
+func TestRetryPolicy_Wait(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	ctx := context.Background()
+
+	assert.NilError(t, p.Wait(ctx, 1, ErrCannotDecryptMessage))
+	assert.NilError(t, p.Wait(ctx, 2, ErrCannotDecryptMessage))
+
+	err := p.Wait(ctx, 3, ErrCannotDecryptMessage)
+	assert.Assert(t, errors.Is(err, ErrRetriesExhausted), err)
+	assert.Assert(t, errors.Is(err, ErrCannotDecryptMessage), err)
+	assert.Error(t, err, "retries exhausted after 3 attempts: cannot decrypt message")
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	p.Backoff = time.Hour
+	err = p.Wait(canceled, 1, ErrCannotDecryptMessage)
+	assert.Assert(t, errors.Is(err, context.Canceled), err)
+}
+
+func TestClient_WaitRetry(t *testing.T) {
+	c, _ := newFlakyClient(t, 0)
+
+	var logs bytes.Buffer
+	c.SetLogger(log.New(&logs, "", 0))
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond})
+
+	ctx := context.Background()
+	assert.NilError(t, c.WaitRetry(ctx, "key exchange", 1, ErrCannotDecryptMessage))
+	assert.Equal(t, logs.String(),
+		"debug: key exchange failed (attempt 1 of 2), retrying in 1ms: cannot decrypt message\n")
+
+	// Nothing is logged when giving up.
+	logs.Reset()
+	err := c.WaitRetry(ctx, "key exchange", 2, ErrCannotDecryptMessage)
+	assert.Assert(t, errors.Is(err, ErrRetriesExhausted), err)
+	assert.Equal(t, logs.String(), "")
+}
@@ -0,0 +1,81 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+import (
+	"bytes"
+	"log"
+)
+
+// Tracer is an Observer that logs every exchange with KeePassXC for
+// debugging: the request and the reply as they were sent and received, the
+// decrypted messages and how long the reply took. Passwords, keys, TOTP
+// codes and custom fields are redacted unless Unsafe is set.
+type Tracer struct {
+	// Logger is the logger the exchanges are logged to. The standard
+	// logger is used if it is nil.
+	Logger *log.Logger
+
+	// Unsafe disables the redaction of secrets.
+	Unsafe bool
+}
+
+func (t *Tracer) Observe(e Exchange) {
+	if e.Sent != nil {
+		t.logf("debug: %s: sent %s", e.Action, t.redact(e.Sent))
+	}
+	if e.Request != nil && !bytes.Equal(e.Request, e.Sent) {
+		t.logf("debug: %s: request %s", e.Action, t.redact(e.Request))
+	}
+
+	if e.Received == nil {
+		t.logf("debug: %s: no reply after %v: %v", e.Action, e.Duration, e.Err)
+		return
+	}
+
+	t.logf("debug: %s: received in %v %s", e.Action, e.Duration, t.redact(e.Received))
+	if e.Reply != nil && !bytes.Equal(e.Reply, e.Received) {
+		t.logf("debug: %s: reply %s", e.Action, t.redact(e.Reply))
+	}
+	if e.Err != nil {
+		t.logf("debug: %s: failed: %v", e.Action, e.Err)
+	}
+}
+
+func (t *Tracer) redact(msg []byte) []byte {
+	if t.Unsafe || msg == nil {
+		return msg
+	}
+
+	return Redact(msg)
+}
+
+func (t *Tracer) logf(format string, v ...interface{}) {
+	if t.Logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+
+	t.Logger.Printf(format, v...)
+}
@@ -0,0 +1,105 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestTracer(t *testing.T) {
+	c := newMockClientFunc(t, func(req Request, msg []byte) interface{} {
+		return `{"password":"hunter2","success":"true"}`
+	})
+
+	for _, tt := range []struct {
+		name   string
+		unsafe bool
+		want   []string
+		hidden []string
+	}{
+		{
+			name:   "redacted",
+			want:   []string{`"password":"REDACTED"`},
+			hidden: []string{"hunter2"},
+		},
+		{
+			name:   "unsafe",
+			unsafe: true,
+			want:   []string{`"password":"hunter2"`},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			c.SetObserver(&Tracer{Logger: log.New(&b, "", 0), Unsafe: tt.unsafe})
+
+			_, err := c.GeneratePassword()
+			assert.NilError(t, err)
+
+			lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+			assert.Equal(t, len(lines), 4, b.String())
+			assert.Assert(t, strings.HasPrefix(lines[0], "debug: generate-password: sent {"), lines[0])
+			assert.Equal(t, lines[1], `debug: generate-password: request {"action":"generate-password"}`)
+			assert.Assert(t, strings.HasPrefix(lines[2], "debug: generate-password: received in "), lines[2])
+			assert.Assert(t, strings.HasPrefix(lines[3], "debug: generate-password: reply {"), lines[3])
+
+			for _, s := range tt.want {
+				assert.Assert(t, strings.Contains(lines[3], s), lines[3])
+			}
+			for _, s := range tt.hidden {
+				assert.Assert(t, !strings.Contains(b.String(), s), b.String())
+			}
+		})
+	}
+}
+
+func TestTracer_noReply(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	c := newMockClientFunc(t, func(req Request, msg []byte) interface{} {
+		<-release
+		return `{}`
+	})
+
+	var b bytes.Buffer
+	c.SetObserver(&Tracer{Logger: log.New(&b, "", 0)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := c.GeneratePasswordContext(ctx)
+	assert.Assert(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert.Equal(t, len(lines), 3, b.String())
+	assert.Assert(t, strings.HasPrefix(lines[2], "debug: generate-password: no reply after "), lines[2])
+	assert.Assert(t, strings.HasSuffix(lines[2], context.DeadlineExceeded.Error()), lines[2])
+}
@@ -0,0 +1,142 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrTransportClosed = errors.New("transport closed")
+
+// Transport carries protocol messages between the client and KeePassXC.
+// A message is a single JSON value.
+type Transport interface {
+	// Send sends one message.
+	Send(msg []byte) error
+	// Receive blocks until the next message arrives.
+	Receive() ([]byte, error)
+	// Close closes the transport, making pending and future calls fail.
+	Close() error
+}
+
+// SocketTransport sends messages over a stream connection, such as the
+// KeePassXC unix socket, as concatenated JSON values.
+type SocketTransport struct {
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+// DialSocket connects to the KeePassXC unix socket at path.
+func DialSocket(path string) (*SocketTransport, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSocketTransport(conn), nil
+}
+
+func NewSocketTransport(conn net.Conn) *SocketTransport {
+	return &SocketTransport{
+		conn: conn,
+		dec:  json.NewDecoder(conn),
+	}
+}
+
+func (t *SocketTransport) Send(msg []byte) error {
+	_, err := t.conn.Write(msg)
+	return err
+}
+
+func (t *SocketTransport) Receive() ([]byte, error) {
+	// The decoder is kept between calls because it may have read ahead.
+	var msg json.RawMessage
+	if err := t.dec.Decode(&msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (t *SocketTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *SocketTransport) SetWriteDeadline(d time.Time) error {
+	return t.conn.SetWriteDeadline(d)
+}
+
+// Pipe returns two connected in-memory transports. Messages sent to one are
+// received from the other. It is meant for tests and embedding a fake
+// KeePassXC.
+func Pipe() (Transport, Transport) {
+	a, b := make(chan []byte, 1), make(chan []byte, 1)
+	done := make(chan struct{})
+	once := &sync.Once{}
+
+	return &pipeTransport{send: a, recv: b, done: done, once: once},
+		&pipeTransport{send: b, recv: a, done: done, once: once}
+}
+
+type pipeTransport struct {
+	send chan<- []byte
+	recv <-chan []byte
+	done chan struct{}
+	once *sync.Once
+}
+
+func (p *pipeTransport) Send(msg []byte) error {
+	m := append([]byte{}, msg...)
+
+	select {
+	case <-p.done:
+		return ErrTransportClosed
+	default:
+	}
+
+	select {
+	case p.send <- m:
+		return nil
+	case <-p.done:
+		return ErrTransportClosed
+	}
+}
+
+func (p *pipeTransport) Receive() ([]byte, error) {
+	select {
+	case m := <-p.recv:
+		return m, nil
+	case <-p.done:
+		return nil, ErrTransportClosed
+	}
+}
+
+func (p *pipeTransport) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
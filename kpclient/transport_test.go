@@ -0,0 +1,87 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSocketTransport(t *testing.T) {
+	k := newMockKeePass(func(c net.Conn) {
+		defer c.Close()
+
+		// Two messages in one write must both be received.
+		if _, err := c.Write([]byte(`{"a":1}` + "\n" + `{"b":2}`)); err != nil {
+			t.Error(err)
+		}
+	})
+	defer k.Close()
+
+	tr := k.Transport()
+	defer tr.Close()
+
+	for _, want := range []string{`{"a":1}`, `{"b":2}`} {
+		msg, err := tr.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, string(msg), want)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	a, b := Pipe()
+
+	go func() {
+		msg, err := b.Receive()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := b.Send(append(msg, '!')); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if err := a.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := a.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(msg), "hello!")
+
+	b.Close()
+	if _, err := a.Receive(); !errors.Is(err, ErrTransportClosed) {
+		t.Fatalf("got err %v, want %v", err, ErrTransportClosed)
+	}
+	if err := a.Send(nil); !errors.Is(err, ErrTransportClosed) {
+		t.Fatalf("got err %v, want %v", err, ErrTransportClosed)
+	}
+}
@@ -0,0 +1,143 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrUnsupportedAction = errors.New("action not supported by this KeePassXC version")
+
+// minVersions are the KeePassXC versions that introduced the actions added
+// after the browser integration itself, in 2.3.0, as listed in KeePassXC's
+// CHANGELOG.md. Actions are only listed when the release that added them is
+// known, since a wrong entry would refuse an action the server supports.
+var minVersions = map[string]string{
+	// 2.5.0 added choosing and creating the group of new entries.
+	ActionGetDatabaseGroups: "2.5.0",
+	ActionCreateNewGroup:    "2.5.0",
+
+	// 2.7.0 added starting Auto-Type from the browser extension.
+	ActionRequestAutotype: "2.7.0",
+
+	// 2.7.7 added passkeys.
+	ActionPasskeysGet:      "2.7.7",
+	ActionPasskeysRegister: "2.7.7",
+}
+
+// ServerVersion returns the KeePassXC version sent in the first reply that
+// had one, usually the reply to ChangePublicKeys. It is empty until then.
+func (c *Client) ServerVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.version
+}
+
+// Supports reports whether the connected KeePassXC supports action. It
+// returns true if the version isn't known yet, or if action isn't known to
+// have been added after 2.3.0.
+func (c *Client) Supports(action string) bool {
+	return c.checkSupported(action) == nil
+}
+
+// checkSupported returns an error wrapping ErrUnsupportedAction if the
+// connected KeePassXC doesn't support action.
+func (c *Client) checkSupported(action string) error {
+	minVersion, ok := minVersions[action]
+	v := c.ServerVersion()
+	if !ok || v == "" || compareVersions(v, minVersion) >= 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s requires KeePassXC %s or later, connected to %s",
+		ErrUnsupportedAction, action, minVersion, v)
+}
+
+func (c *Client) setVersion(v string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.version == "" {
+		c.version = v
+	}
+}
+
+// setVersionFrom sets the version from a reply message, unless it is known.
+func (c *Client) setVersionFrom(msg []byte) {
+	if c.ServerVersion() != "" {
+		return
+	}
+
+	var m struct {
+		Version string `json:"version"`
+	}
+	if json.Unmarshal(msg, &m) == nil {
+		c.setVersion(m.Version)
+	}
+}
+
+// compareVersions compares dotted version numbers such as "2.7.9",
+// returning -1, 0 or 1. Anything after the numbers, as in "2.8.0-snapshot",
+// is ignored, and missing or invalid numbers count as 0.
+func compareVersions(a, b string) int {
+	as, bs := versionNumbers(a), versionNumbers(b)
+	for len(as) < len(bs) {
+		as = append(as, 0)
+	}
+	for len(bs) < len(as) {
+		bs = append(bs, 0)
+	}
+
+	for i := range as {
+		switch {
+		case as[i] < bs[i]:
+			return -1
+		case as[i] > bs[i]:
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func versionNumbers(v string) []int {
+	if i := strings.IndexFunc(v, func(r rune) bool {
+		return r != '.' && (r < '0' || r > '9')
+	}); i >= 0 {
+		v = v[:i]
+	}
+
+	var ns []int
+	for _, s := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(s)
+		ns = append(ns, n)
+	}
+
+	return ns
+}
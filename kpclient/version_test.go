@@ -0,0 +1,92 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func Test_compareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"2.7.9", "2.7.9", 0},
+		{"2.7.10", "2.7.9", 1},
+		{"2.6.6", "2.7.0", -1},
+		{"2.7", "2.7.0", 0},
+		{"2.8.0-snapshot", "2.7.7", 1},
+		{"2.7.7-beta1", "2.7.7", 0},
+		{"", "2.3.0", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			assert.Equal(t, compareVersions(tt.a, tt.b), tt.want)
+			assert.Equal(t, compareVersions(tt.b, tt.a), -tt.want)
+		})
+	}
+}
+
+func TestClient_Supports(t *testing.T) {
+	var n int32
+	c := newMockClientFunc(t, func(req Request, msg []byte) interface{} {
+		atomic.AddInt32(&n, 1)
+		return `{"password":"pass","success":"true","version":"2.6.6"}`
+	})
+
+	// Everything is supported until the version is known.
+	assert.Equal(t, c.ServerVersion(), "")
+	assert.Assert(t, c.Supports(ActionRequestAutotype))
+
+	_, err := c.GeneratePassword()
+	assert.NilError(t, err)
+	assert.Equal(t, c.ServerVersion(), "2.6.6")
+
+	assert.Assert(t, c.Supports(ActionGetLogins))
+	assert.Assert(t, c.Supports(ActionGetTOTP))
+	assert.Assert(t, !c.Supports(ActionRequestAutotype))
+	assert.Assert(t, !c.Supports(ActionPasskeysGet))
+
+	_, err = c.RequestAutotype("https://example.com")
+	assert.Assert(t, errors.Is(err, ErrUnsupportedAction), err)
+	assert.Error(t, err, "action not supported by this KeePassXC version: "+
+		"request-autotype requires KeePassXC 2.7.0 or later, connected to 2.6.6")
+	assert.Equal(t, atomic.LoadInt32(&n), int32(1)) // not sent
+}
+
+func TestClient_ServerVersion(t *testing.T) {
+	c := newMockClientFunc(t, func(req Request, msg []byte) interface{} {
+		return `{"password":"pass","success":"true","version":"2.7.9"}`
+	})
+	c.setVersion("2.7.4")
+
+	// The version from the first reply is kept.
+	_, err := c.GeneratePassword()
+	assert.NilError(t, err)
+	assert.Equal(t, c.ServerVersion(), "2.7.4")
+}
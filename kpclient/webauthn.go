@@ -0,0 +1,111 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2020 cupnoodles
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//
+//
+package kpclient
+
+// WebAuthn types exchanged with KeePassXC by the passkeys actions. They
+// follow the JSON serialization of the WebAuthn Level 3 types: binary values
+// (challenges, credential and user IDs, authenticator data) are base64url
+// strings without padding.
+
+type PublicKeyCredentialCreationOptions struct {
+	RP                     PublicKeyCredentialRPEntity     `json:"rp"`
+	User                   PublicKeyCredentialUserEntity   `json:"user"`
+	Challenge              string                          `json:"challenge"`
+	PubKeyCredParams       []PublicKeyCredentialParameters `json:"pubKeyCredParams"`
+	Timeout                int                             `json:"timeout,omitempty"`
+	ExcludeCredentials     []PublicKeyCredentialDescriptor `json:"excludeCredentials,omitempty"`
+	AuthenticatorSelection *AuthenticatorSelectionCriteria `json:"authenticatorSelection,omitempty"`
+	Attestation            string                          `json:"attestation,omitempty"`
+	Extensions             map[string]interface{}          `json:"extensions,omitempty"`
+}
+
+type PublicKeyCredentialRequestOptions struct {
+	Challenge        string                          `json:"challenge"`
+	Timeout          int                             `json:"timeout,omitempty"`
+	RPID             string                          `json:"rpId,omitempty"`
+	AllowCredentials []PublicKeyCredentialDescriptor `json:"allowCredentials,omitempty"`
+	UserVerification string                          `json:"userVerification,omitempty"`
+	Extensions       map[string]interface{}          `json:"extensions,omitempty"`
+}
+
+type PublicKeyCredentialRPEntity struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+type PublicKeyCredentialUserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type PublicKeyCredentialParameters struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"` // COSE algorithm identifier
+}
+
+type PublicKeyCredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelectionCriteria struct {
+	AuthenticatorAttachment string `json:"authenticatorAttachment,omitempty"`
+	ResidentKey             string `json:"residentKey,omitempty"`
+	RequireResidentKey      bool   `json:"requireResidentKey,omitempty"`
+	UserVerification        string `json:"userVerification,omitempty"`
+}
+
+// PublicKeyCredentialAttestation is a credential created by passkeys-register.
+type PublicKeyCredentialAttestation struct {
+	ID                      string                           `json:"id"`
+	RawID                   string                           `json:"rawId"`
+	Type                    string                           `json:"type"`
+	AuthenticatorAttachment string                           `json:"authenticatorAttachment"`
+	Response                AuthenticatorAttestationResponse `json:"response"`
+	ClientExtensionResults  map[string]interface{}           `json:"clientExtensionResults,omitempty"`
+}
+
+type AuthenticatorAttestationResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+}
+
+// PublicKeyCredentialAssertion is an assertion returned by passkeys-get.
+type PublicKeyCredentialAssertion struct {
+	ID                      string                         `json:"id"`
+	RawID                   string                         `json:"rawId"`
+	Type                    string                         `json:"type"`
+	AuthenticatorAttachment string                         `json:"authenticatorAttachment"`
+	Response                AuthenticatorAssertionResponse `json:"response"`
+	ClientExtensionResults  map[string]interface{}         `json:"clientExtensionResults,omitempty"`
+}
+
+type AuthenticatorAssertionResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
@@ -24,15 +24,17 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"time"
@@ -41,32 +43,149 @@ import (
 )
 
 var (
-	ErrTOTPUUIDRequired = errors.New("entry UUID is required")
+	ErrUUIDRequired     = errors.New("entry UUID is required")
 	ErrURLRequired      = errors.New("URL argument is required")
+	ErrPasswordRequired = errors.New("password is required on stdin")
+	ErrStdinInUse       = errors.New("stdin is already used to read the identity")
+	ErrGroupRequired    = errors.New("group path argument is required")
+	ErrConnectionClosed = errors.New("connection to keepassxc closed")
+	ErrProxyRequired    = errors.New("proxy command is required")
+	ErrNoConfirmation   = errors.New("no answer to the confirmation prompt, use -yes to delete without asking")
+
+	ErrSocketNotFound    = errors.New("keepassxc socket not found")
+	ErrAssociationDenied = errors.New("association denied")
 )
 
-type Association struct {
-	ID    string `json:"id"`
-	IDKey []byte `json:"idKey"`
+// Exit codes. They are documented in README.md.
+const (
+	exitError             = 1
+	exitUsage             = 2 // same as for invalid flags
+	exitNoLogins          = 3
+	exitLocked            = 4
+	exitAssociationDenied = 5
+	exitSocketNotFound    = 6
+	exitTimeout           = 7
+)
+
+// usageError is an error in the command line arguments.
+type usageError struct {
+	error
+}
+
+func (e usageError) Unwrap() error {
+	return e.error
+}
+
+// exitCode returns the exit code for an error returned by App.Run.
+func exitCode(err error) int {
+	var uerr usageError
+	switch {
+	case errors.As(err, &uerr):
+		return exitUsage
+	case errors.Is(err, kpclient.ErrNoLoginsFound):
+		return exitNoLogins
+	case errors.Is(err, kpclient.ErrDatabaseNotOpened):
+		return exitLocked
+	case errors.Is(err, ErrAssociationDenied), errors.Is(err, kpclient.ErrAssociationFailed):
+		return exitAssociationDenied
+	case errors.Is(err, ErrSocketNotFound):
+		return exitSocketNotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		return exitTimeout
+	default:
+		return exitError
+	}
 }
 
 type Opts struct {
 	associationFile string
 	format          string
 	sockets         []string
+	proxy           string
 	printJSON       bool
 	associateOnly   bool
 	waitForUnlock   bool
 	triggerUnlock   bool
 	totp            bool
+	timeout         time.Duration
+	retries         int
+	record          string
+	debug           bool
+	debugUnsafe     bool
+	loginsOptions   kpclient.GetLoginsOptions
 }
 
 type App struct {
-	client *kpclient.Client
-	opts   Opts
+	client   *kpclient.Client
+	opts     Opts
+	recorder *kpclient.Recorder
+
+	// skipAssociation is set by commands that only need a connection.
+	skipAssociation bool
+	// skipConnect is set by commands that connect on their own.
+	skipConnect bool
 }
 
-func (a *App) connect() error {
+// dial connects to KeePassXC without exchanging keys.
+func (a *App) dial() (err error) {
+	var t kpclient.Transport
+	if a.opts.proxy != "" {
+		t, err = dialProxy(a.opts.proxy)
+	} else {
+		for _, s := range a.opts.sockets {
+			if t, err = kpclient.DialSocket(s); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrSocketNotFound, err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting to keepassxc: %w", err)
+	}
+
+	if a.opts.record != "" {
+		a.recorder = kpclient.NewRecorder(t)
+		t = a.recorder
+	}
+
+	a.client, err = kpclient.New(t, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("failed to initialize client: %w", err)
+	}
+
+	policy := kpclient.DefaultRetryPolicy
+	policy.MaxAttempts = a.opts.retries + 1
+	a.client.SetRetryPolicy(policy)
+
+	if a.opts.debug {
+		logger := log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
+		a.client.SetLogger(logger)
+
+		tracer := &kpclient.Tracer{Logger: logger, Unsafe: a.opts.debugUnsafe}
+		if a.recorder != nil {
+			a.client.SetObserver(kpclient.Observers{a.recorder, tracer})
+		} else {
+			a.client.SetObserver(tracer)
+		}
+	}
+
+	return nil
+}
+
+// dialProxy starts a proxy command line such as
+// "flatpak run --command=keepassxc-proxy org.keepassxc.KeePassXC".
+func dialProxy(cmdline string) (kpclient.Transport, error) {
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return nil, ErrProxyRequired
+	}
+
+	return kpclient.DialProxy(args[0], args[1:]...)
+}
+
+func (a *App) connect(ctx context.Context) error {
 	var r io.ReadCloser
 	switch {
 	case a.opts.associateOnly: // reader stays nil to generate a new association.
@@ -81,54 +200,49 @@ func (a *App) connect() error {
 		}
 	}
 
-	var as Association
+	var id Identity
 	if r != nil {
-		err := json.NewDecoder(r).Decode(&as)
-		if err != nil {
-			return fmt.Errorf("failed to decode saved association info: %w", err)
+		var err error
+		if id, err = loadIdentity(r); err != nil {
+			return err
 		}
 		r.Close()
 	}
 
-	var err error
-	var conn net.Conn
-	for _, s := range a.opts.sockets {
-		if conn, err = net.Dial("unix", s); err != nil {
-			continue
-		}
-	}
+	err := a.dial()
 	if err != nil {
-		return fmt.Errorf("error connecting to keepassxc: %w", err)
+		return err
 	}
 
-	a.client, err = kpclient.New(conn, nil, as.IDKey, as.ID)
-	if err != nil {
-		return fmt.Errorf("failed to initialize client: %w", err)
+	// Entries are looked up in all associated databases.
+	for _, as := range id {
+		a.client.AddAssociation(as.IDKey, as.ID)
 	}
 
 	triggerUnlock := a.opts.triggerUnlock
 
-	retries := 0
+	retries, attempts := 0, 0
 	for {
-		if _, err = a.client.ChangePublicKeys(); err != nil {
+		if _, err = a.client.ChangePublicKeysContext(ctx); err != nil {
 			return fmt.Errorf("failed to exchange public keys: %w", err)
 		}
 
-		if _, err = a.client.TestAssociate(triggerUnlock); err == nil {
-			return nil // OK! we're associated and connected
-		}
+		hash, err := a.client.GetDatabaseHashContext(ctx, triggerUnlock)
 
 		// Sometimes key exchange fails and we can't decrypt the messages.
 		// This can be fixed by exchanging keys again.
 		// TODO: find out why this is happening
 		if errors.Is(err, kpclient.ErrCannotDecryptMessage) {
+			attempts++
+			if err = a.client.WaitRetry(ctx, "key exchange", attempts, err); err != nil {
+				return fmt.Errorf("failed to get database hash: %w", err)
+			}
 			continue
 		}
 
-		// If we're associated and the DB is closed, we try again later.
+		// If the DB is closed, we try again later.
 		// (We get a new keypair but it keeps code shorter).
-		_, ident := a.client.AssociationData()
-		if errors.Is(err, kpclient.ErrDatabaseNotOpened) && ident != "" {
+		if errors.Is(err, kpclient.ErrDatabaseNotOpened) {
 			if !a.opts.waitForUnlock {
 				return fmt.Errorf("failed to open database: %w", err)
 			}
@@ -137,44 +251,75 @@ func (a *App) connect() error {
 			retries++
 			triggerUnlock = false // we don't want keepass window to steal focus every second
 
-			time.Sleep(time.Second)
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("failed to open database: %w", ctx.Err())
+			case <-time.After(time.Second):
+			}
 			continue
 		}
-		// If all's fine, we get a new identity key and save it.
-		// Failing after this point is unexpected, so we don't retry.
-		if _, err = a.client.Associate(); err != nil {
-			return fmt.Errorf("failed to associate: %w", err)
+		if err != nil {
+			return fmt.Errorf("failed to get database hash: %w", err)
 		}
 
-		return a.saveToFile(a.opts.associationFile)
-	}
-}
-
-func (a *App) saveToFile(file string) (err error) {
-	idkey, ident := a.client.AssociationData()
-	as := Association{IDKey: idkey[:], ID: ident}
-
-	var w io.WriteCloser
-	if file == "" || file == "-" || a.opts.associateOnly {
-		w = os.Stdout
-	} else {
-		if err = os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
-			// we may try to ignore the error and hope that WriteFile succeeds anyway
-			log.Println("info:", err)
+		as, ok := id.Find(hash)
+		if ok {
+			a.client.SetAssociation(as.IDKey, as.ID)
+
+			_, err = a.client.TestAssociateContext(ctx, triggerUnlock)
+			if errors.Is(err, kpclient.ErrCannotDecryptMessage) {
+				attempts++
+				if err = a.client.WaitRetry(ctx, "key exchange", attempts, err); err != nil {
+					return fmt.Errorf("failed to test association: %w", err)
+				}
+				continue
+			}
+			if err == nil {
+				if as.Hash != "" {
+					return nil // OK! we're associated and connected
+				}
+
+				// Remember which database the association belongs to.
+				as.Hash = hash
+				if a.opts.associationFile == "" || a.opts.associationFile == "-" {
+					return nil
+				}
+				return saveIdentity(a.opts.associationFile, id)
+			}
+		} else if len(id) > 0 {
+			log.Printf("warning: the identity has no association with the current database (%s), "+
+				"associating a new one", hash)
 		}
 
-		w, err = os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+		// If all's fine, we get a new identity key and save it.
+		// Failing after this point is unexpected, so we don't retry.
+		newKey, err := kpclient.Nonce()
 		if err != nil {
 			return err
 		}
-		defer w.Close()
-	}
+		a.client.SetAssociation(newKey[:], "")
+
+		_, err = a.client.AssociateContext(ctx)
+		if errors.Is(err, kpclient.ErrActionCancelledOrDenied) {
+			err = fmt.Errorf("%w: %w", ErrAssociationDenied, err)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to associate: %w", err)
+		}
 
-	return json.NewEncoder(w).Encode(as)
+		idKey, ident := a.client.AssociationData()
+		newAs := Association{ID: ident, IDKey: idKey[:], Hash: hash}
+		if a.opts.associateOnly {
+			return saveIdentity("-", Identity{newAs})
+		}
+
+		id.Set(newAs)
+		return saveIdentity(a.opts.associationFile, id)
+	}
 }
 
-func (a *App) printTOTP(uuid string) (err error) {
-	totp, err := a.client.GetTOTP(uuid)
+func (a *App) printTOTP(ctx context.Context, uuid string) (err error) {
+	totp, err := a.client.GetTOTPContext(ctx, uuid)
 	if err != nil {
 		return
 	}
@@ -187,8 +332,8 @@ func (a *App) printTOTP(uuid string) (err error) {
 	return
 }
 
-func (a *App) printEntry(u string) error {
-	logins, err := a.client.GetLogins(u)
+func (a *App) printEntry(ctx context.Context, u string) error {
+	logins, err := a.client.GetLoginsContext(ctx, u, a.opts.loginsOptions)
 	if err != nil {
 		return err
 	}
@@ -201,6 +346,317 @@ func (a *App) printEntry(u string) error {
 	return err
 }
 
+func (a *App) printPassword(ctx context.Context) error {
+	resp, err := a.client.GeneratePasswordContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if a.opts.printJSON {
+		return json.NewEncoder(os.Stdout).Encode(resp)
+	}
+
+	fmt.Print(resp.Password)
+	return nil
+}
+
+func (a *App) setLogin(args []string) (func(ctx context.Context) error, error) {
+	var opts kpclient.LoginOptions
+
+	fs := flag.NewFlagSet("set", flag.ExitOnError)
+	fs.StringVar(&opts.Login, "login", "", "entry username")
+	fs.StringVar(&opts.SubmitURL, "submit-url", "", "form submit URL (defaults to url)")
+	fs.StringVar(&opts.Group, "group", "", "name of the group to create the entry in")
+	fs.StringVar(&opts.GroupUUID, "group-uuid", "", "UUID of the group to create the entry in")
+	fs.StringVar(&opts.UUID, "uuid", "", "UUID of an existing entry to update")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage of kpxcpc set:\n  kpxcpc [flags] set [set flags] url < password")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return nil, ErrURLRequired
+	}
+	opts.URL = fs.Arg(0)
+
+	if a.opts.associationFile == "-" {
+		return nil, ErrStdinInUse
+	}
+
+	pass, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password: %w", err)
+	}
+	opts.Password = strings.TrimSuffix(strings.TrimSuffix(string(pass), "\n"), "\r")
+	if opts.Password == "" {
+		return nil, ErrPasswordRequired
+	}
+
+	return func(ctx context.Context) error {
+		_, err := a.client.SetLoginContext(ctx, opts)
+		return err
+	}, nil
+}
+
+// lock locks the database. It doesn't need an association.
+func (a *App) lock(ctx context.Context) error {
+	attempts := 0
+	for {
+		if _, err := a.client.ChangePublicKeysContext(ctx); err != nil {
+			return fmt.Errorf("failed to exchange public keys: %w", err)
+		}
+
+		_, err := a.client.LockDatabaseContext(ctx)
+		if errors.Is(err, kpclient.ErrCannotDecryptMessage) {
+			attempts++
+			if err = a.client.WaitRetry(ctx, "key exchange", attempts, err); err != nil {
+				return fmt.Errorf("failed to lock database: %w", err)
+			}
+			continue
+		}
+
+		return err
+	}
+}
+
+func (a *App) groups(args []string) (func(ctx context.Context) error, error) {
+	fs := flag.NewFlagSet("groups", flag.ExitOnError)
+	paths := fs.Bool("paths", false, "print slash-separated group paths instead of a tree")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage of kpxcpc groups:\n  kpxcpc [flags] groups [-paths]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	return func(ctx context.Context) error {
+		resp, err := a.client.GetDatabaseGroupsContext(ctx)
+		if err != nil {
+			return err
+		}
+
+		if a.opts.printJSON {
+			return json.NewEncoder(os.Stdout).Encode(resp.Groups.Groups)
+		}
+
+		var b strings.Builder
+		for i := range resp.Groups.Groups {
+			if *paths {
+				formatGroupPaths(&b, "", &resp.Groups.Groups[i])
+			} else {
+				formatGroupTree(&b, 0, &resp.Groups.Groups[i])
+			}
+		}
+		fmt.Print(b.String())
+		return nil
+	}, nil
+}
+
+// formatGroupTree writes the UUID and the name of g and its children
+// indented by their depth.
+func formatGroupTree(b *strings.Builder, depth int, g *kpclient.Group) {
+	fmt.Fprintf(b, "%s  %s%s\n", g.UUID, strings.Repeat("  ", depth), g.Name)
+	for i := range g.Children {
+		formatGroupTree(b, depth+1, &g.Children[i])
+	}
+}
+
+// formatGroupPaths writes the UUID and the path of g and its children.
+// Paths are relative to the root group, which is written as "/".
+func formatGroupPaths(b *strings.Builder, parent string, g *kpclient.Group) {
+	path := "/"
+	if parent != "" {
+		path = strings.TrimSuffix(parent, "/") + "/" + g.Name
+	}
+
+	fmt.Fprintf(b, "%s  %s\n", g.UUID, path)
+	for i := range g.Children {
+		formatGroupPaths(b, path, &g.Children[i])
+	}
+}
+
+func (a *App) mkgroup(args []string) (func(ctx context.Context) error, error) {
+	if len(args) == 0 {
+		return nil, ErrGroupRequired
+	}
+
+	paths := make([]string, 0, len(args))
+	for _, p := range args {
+		// KeePassXC resolves paths from the root group and doesn't like
+		// empty path elements.
+		var elems []string
+		for _, e := range strings.Split(p, "/") {
+			if e != "" {
+				elems = append(elems, e)
+			}
+		}
+		if len(elems) == 0 {
+			return nil, fmt.Errorf("%w: %q", ErrGroupRequired, p)
+		}
+		paths = append(paths, strings.Join(elems, "/"))
+	}
+
+	return func(ctx context.Context) error {
+		for _, p := range paths {
+			resp, err := a.client.CreateNewGroupContext(ctx, p)
+			if err != nil {
+				return fmt.Errorf("can't create group %s: %w", p, err)
+			}
+
+			if a.opts.printJSON {
+				err = json.NewEncoder(os.Stdout).Encode(resp)
+			} else {
+				_, err = fmt.Println(resp.UUID)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+func (a *App) remove(args []string) (func(ctx context.Context) error, error) {
+	fs := flag.NewFlagSet("rm", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "do not ask for confirmation")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage of kpxcpc rm:\n  kpxcpc [flags] rm [-yes] uuid...")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	uuids := fs.Args()
+	if len(uuids) == 0 {
+		return nil, ErrUUIDRequired
+	}
+
+	if !*yes && a.opts.associationFile == "-" {
+		return nil, ErrStdinInUse
+	}
+
+	return func(ctx context.Context) error {
+		stdin := bufio.NewReader(os.Stdin)
+		for _, u := range uuids {
+			if !*yes {
+				fmt.Fprintf(os.Stderr, "delete entry %s? [y/N] ", u)
+				answer, err := stdin.ReadString('\n')
+				if errors.Is(err, io.EOF) && answer == "" {
+					// Nobody is there to answer, e.g. stdin is /dev/null.
+					fmt.Fprintln(os.Stderr)
+					return ErrNoConfirmation
+				}
+				if err != nil && !errors.Is(err, io.EOF) {
+					return err
+				}
+				if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+					continue
+				}
+			}
+
+			_, err := a.client.DeleteEntryContext(ctx, u)
+			if errors.Is(err, kpclient.ErrEntryNotDeleted) {
+				return fmt.Errorf("KeePassXC didn't delete entry %s "+
+					"(there is no such entry in the active database, or the deletion was denied): %w", u, err)
+			}
+			if errors.Is(err, kpclient.ErrActionCancelledOrDenied) {
+				return fmt.Errorf("KeePassXC refused to delete entry %s "+
+					"(the request was denied in KeePassXC or entry deletion isn't allowed): %w", u, err)
+			}
+			if err != nil {
+				return fmt.Errorf("can't delete entry %s: %w", u, err)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// version prints the versions of kpxcpc and of KeePassXC. The kpxcpc version
+// is printed even if KeePassXC can't be reached.
+func (a *App) version(ctx context.Context) error {
+	v := struct {
+		Client string `json:"client"`
+		Server string `json:"server"`
+	}{Client: clientVersion()}
+
+	if !a.opts.printJSON {
+		fmt.Println("kpxcpc", v.Client)
+	}
+
+	if err := a.dial(); err != nil {
+		return err
+	}
+	if _, err := a.client.ChangePublicKeysContext(ctx); err != nil {
+		return fmt.Errorf("failed to exchange public keys: %w", err)
+	}
+
+	// Old versions don't send it.
+	v.Server = a.client.ServerVersion()
+	if v.Server == "" {
+		v.Server = "unknown"
+	}
+
+	if a.opts.printJSON {
+		return json.NewEncoder(os.Stdout).Encode(v)
+	}
+
+	fmt.Println("KeePassXC", v.Server)
+	return nil
+}
+
+// clientVersion returns the module version kpxcpc was built from, with the
+// VCS revision for builds from a checkout.
+func clientVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	v := info.Main.Version
+	if v != "" && v != "(devel)" {
+		return v
+	}
+
+	var rev, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				modified = "-dirty"
+			}
+		}
+	}
+	if rev == "" {
+		return "devel"
+	}
+	if len(rev) > 12 {
+		rev = rev[:12]
+	}
+
+	return "devel-" + rev + modified
+}
+
+// watch prints notifications from KeePassXC as JSON lines until the
+// connection is closed. KeePassXC sends them to every connected client,
+// so no association is needed.
+func (a *App) watch(ctx context.Context) error {
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		select {
+		case e, ok := <-a.client.Events():
+			if !ok {
+				return ErrConnectionClosed
+			}
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 func formatEntries(format string, entries []kpclient.LoginEntry) string {
 	var b strings.Builder
 	for i := range entries {
@@ -224,42 +680,162 @@ func formatEntries(format string, entries []kpclient.LoginEntry) string {
 	return b.String()
 }
 
-func (a *App) Run() error {
-	err := a.connect()
-	if err != nil {
-		return err
-	}
-
+// command parses the command line arguments and returns a function
+// that performs the requested operation once the client is connected.
+func (a *App) command(args []string) (func(ctx context.Context) error, error) {
 	switch {
 	case a.opts.associateOnly:
-		return err
+		return func(context.Context) error { return nil }, nil
 	case a.opts.totp:
-		uuids := flag.Args()
-		if len(uuids) == 0 {
-			return ErrTOTPUUIDRequired
+		if len(args) == 0 {
+			return nil, ErrUUIDRequired
 		}
 
-		for _, u := range uuids {
-			err = a.printTOTP(u)
-			if err != nil {
-				// Note: currently it seems like keepass silently fails with
-				// `"success": "true"` if no entry exists/no totp is set up.
-				return err
+		return func(ctx context.Context) error {
+			for _, u := range args {
+				if err := a.printTOTP(ctx, u); err != nil {
+					// Note: currently it seems like keepass silently fails with
+					// `"success": "true"` if no entry exists/no totp is set up.
+					return err
+				}
 			}
-		}
-	default:
-		urls := flag.Args()
-		if len(urls) == 0 {
-			return ErrURLRequired
+			return nil
+		}, nil
+	case len(args) == 0:
+		return nil, ErrURLRequired
+	}
+
+	switch args[0] {
+	case "generate":
+		return a.printPassword, nil
+	case "set":
+		return a.setLogin(args[1:])
+	case "lock":
+		a.skipAssociation = true
+		return a.lock, nil
+	case "groups":
+		return a.groups(args[1:])
+	case "mkgroup":
+		return a.mkgroup(args[1:])
+	case "rm":
+		return a.remove(args[1:])
+	case "watch":
+		a.skipAssociation = true
+		return a.watch, nil
+	case "version":
+		a.skipConnect = true
+		return a.version, nil
+	case "autotype":
+		if len(args) != 2 {
+			return nil, ErrURLRequired
 		}
 
-		for _, u := range urls {
-			if err = a.printEntry(u); err != nil {
-				return fmt.Errorf("can't print logins for %s: %w", u, err)
+		return func(ctx context.Context) error {
+			_, err := a.client.RequestAutotypeContext(ctx, args[1])
+			return err
+		}, nil
+	default:
+		return func(ctx context.Context) error {
+			for _, u := range args {
+				if err := a.printEntry(ctx, u); err != nil {
+					return fmt.Errorf("can't print logins for %s: %w", u, err)
+				}
 			}
+			return nil
+		}, nil
+	}
+}
+
+func (a *App) Run() (err error) {
+	run, err := a.command(flag.Args())
+	if err != nil {
+		return usageError{err}
+	}
+
+	ctx := context.Background()
+	if a.opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.opts.timeout)
+		defer cancel()
+	}
+
+	defer func() {
+		if rerr := a.saveRecording(); rerr != nil && err == nil {
+			err = rerr
 		}
+	}()
+
+	switch {
+	case a.skipConnect:
+	case a.skipAssociation:
+		err = a.dial()
+	default:
+		err = a.connect(ctx)
 	}
-	return nil
+	if err != nil {
+		return err
+	}
+
+	return run(ctx)
+}
+
+// saveRecording writes the session recorded with -record, if any.
+func (a *App) saveRecording() error {
+	if a.recorder == nil {
+		return nil
+	}
+
+	f, err := os.Create(a.opts.record)
+	if err != nil {
+		return fmt.Errorf("failed to save recording: %w", err)
+	}
+	defer f.Close()
+
+	if err := a.recorder.WriteSession(f); err != nil {
+		return fmt.Errorf("failed to save recording: %w", err)
+	}
+
+	return f.Close()
+}
+
+func usage() {
+	fmt.Fprint(flag.CommandLine.Output(), `Usage of kpxcpc:
+  kpxcpc [flags] url...
+  kpxcpc [flags] -totp uuid...
+  kpxcpc [flags] generate
+  kpxcpc [flags] set [set flags] url < password
+  kpxcpc [flags] lock
+  kpxcpc [flags] groups [-paths]
+  kpxcpc [flags] mkgroup path...
+  kpxcpc [flags] rm [-yes] uuid...
+  kpxcpc [flags] autotype url
+  kpxcpc [flags] watch
+  kpxcpc [flags] version
+
+Commands:
+  generate
+    	print a password from KeePassXC's password generator
+  set
+    	create or update an entry, reading its password from stdin
+    	(see kpxcpc set -h)
+  lock
+    	lock the active database
+  groups
+    	print the group tree of the active database with group UUIDs
+  mkgroup
+    	create groups and their parents if needed, print their UUIDs
+  rm
+    	delete entries, asking for confirmation unless -yes is given
+  autotype
+    	make KeePassXC auto-type an entry matching url into the focused window
+  watch
+    	print database lock and unlock events as JSON lines
+  version
+    	print the versions of kpxcpc and of the connected KeePassXC
+
+Flags:
+`)
+	flag.PrintDefaults()
 }
 
 func main() {
@@ -271,15 +847,38 @@ func main() {
 	}
 
 	socket := flag.String("socket", "", "path to keepassxc-proxy socket")
+	flag.StringVar(&opts.proxy, "proxy", "",
+		"connect through the given keepassxc-proxy command using native messaging\n  instead of the socket")
 	flag.StringVar(&opts.associationFile, "identity", filepath.Join(datahome, "kpxcpc", "identity.json"), "set identity file")
 	flag.BoolVar(&opts.printJSON, "json", false, "print json")
 	flag.BoolVar(&opts.associateOnly, "associate", false, "associate and print association info to stdout in json format")
 	flag.BoolVar(&opts.totp, "totp", false, "get TOTP")
 	flag.StringVar(&opts.format, "fmt", "%p",
 		"format string for entry fields: name - %n, login - %l, pass - %p,\n  uuid - %u, custom fields - %F:fieldname\n  ")
+	flag.StringVar(&opts.loginsOptions.SubmitURL, "submit-url", "", "match entries by the URL the login form is submitted to")
+	flag.BoolVar(&opts.loginsOptions.HTTPAuth, "http-auth", false, "get entries for HTTP basic authentication")
+	flag.DurationVar(&opts.timeout, "timeout", 0, "give up if KeePassXC doesn't answer within the given time, e.g. 10s\n  (0 waits forever)")
+	flag.IntVar(&opts.retries, "retries", kpclient.DefaultRetryPolicy.MaxAttempts-1,
+		"number of times to retry a request that failed with a transient error")
+	flag.StringVar(&opts.record, "record", "",
+		"record the decrypted exchanges with KeePassXC to the given file, with secrets redacted,\n  for use with kpxctest.NewReplayServer")
+	flag.BoolVar(&opts.debug, "debug", false,
+		"log the exchanges with KeePassXC to stderr, with secrets redacted")
+	flag.BoolVar(&opts.debugUnsafe, "debug-unsafe", false,
+		"like -debug, but without redacting passwords, keys and TOTP codes")
 	nounlock := flag.Bool("nounlock", false, "do not trigger DB unlock prompt")
+	flag.Usage = usage
 	flag.Parse()
 
+	if opts.retries < 0 {
+		opts.retries = 0
+	}
+
+	if opts.debugUnsafe {
+		opts.debug = true
+		log.Print("warning: -debug-unsafe logs passwords and keys")
+	}
+
 	opts.triggerUnlock = !*nounlock
 	opts.waitForUnlock = !*nounlock
 
@@ -289,8 +888,8 @@ func main() {
 
 		opts.format, err = strconv.Unquote(`"` + strings.ReplaceAll(opts.format, `"`, `\"`) + `"`)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			fmt.Fprintln(os.Stderr, "invalid -fmt:", err)
+			os.Exit(exitUsage)
 		}
 	}
 
@@ -307,7 +906,7 @@ func main() {
 
 	app := &App{opts: opts}
 	if err := app.Run(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitCode(err))
 	}
 }